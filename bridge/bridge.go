@@ -52,6 +52,7 @@ type Bridge struct {
 	ipVerify       bool
 	runList        sync.Map //map[int]interface{}
 	disconnectTime int
+	autoPorts      sync.Map //the ports allocated to the tunnels of the clients, reused after reconnecting
 }
 
 func NewTunnel(tunnelPort int, tunnelType string, ipVerify bool, runList sync.Map, disconnectTime int) *Bridge {
@@ -100,7 +101,7 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 				if v.Client.Id == id && v.Mode == "tcp" && strings.Contains(v.Target.TargetStr, info) {
 					v.Lock()
 					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
+						v.Target.TargetArr = v.Target.TargetAddrs()
 					}
 					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
 					if v.HealthRemoveArr == nil {
@@ -116,7 +117,7 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 				if v.Client.Id == id && strings.Contains(v.Target.TargetStr, info) {
 					v.Lock()
 					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
+						v.Target.TargetArr = v.Target.TargetAddrs()
 					}
 					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
 					if v.HealthRemoveArr == nil {
@@ -314,7 +315,19 @@ func (s *Bridge) register(c *conn.Conn) {
 func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (target net.Conn, err error) {
 	//if the proxy type is local
 	if link.LocalProxy {
-		target, err = net.Dial("tcp", link.Host)
+		addr, isHttps := conn.SplitHttpsTarget(link.Host)
+		if target, err = net.Dial("tcp", addr); err == nil && link.Option.ProxyProtocol > 0 {
+			err = common.WriteProxyProtocol(target, link.Option.ProxyProtocol, link.RemoteAddr, target.RemoteAddr())
+		}
+		if err == nil && isHttps {
+			var tlsConn net.Conn
+			if tlsConn, err = conn.NewTlsTargetConn(target, addr, link.Option.Tls, link.Option.Timeout); err != nil {
+				target.Close()
+				target = nil
+			} else {
+				target = tlsConn
+			}
+		}
 		return
 	}
 	if v, ok := s.Client.Load(clientId); ok {
@@ -447,6 +460,12 @@ loop:
 				c.WriteAddFail()
 				break loop
 			}
+			if _, err := file.ParseRouteRules(h.RouteRules); err != nil {
+				logs.Warn("the route rules of the host %s error %s", h.Host, err.Error())
+				fail = true
+				c.WriteAddFail()
+				break loop
+			}
 			h.Client = client
 			if h.Location == "" {
 				h.Location = "/"
@@ -469,8 +488,37 @@ loop:
 				c.WriteAddFail()
 				break loop
 			} else {
+				if _, err := file.ParseAclRules(t.DestAcl); err != nil {
+					logs.Warn("the destination rules of the tunnel %s error %s", t.Remark, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
+				//the country rules are checked by the geoip database of the server
+				if _, err := file.NewVisitorFilter(t.VisitorAllow, t.VisitorDeny); err != nil {
+					logs.Warn("the visitor lists of the tunnel %s error %s", t.Remark, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
 				ports := common.GetPorts(t.Ports)
 				targets := common.GetPorts(t.Target.TargetStr)
+				autoPort := common.IsAutoPort(t.Ports) && t.Mode != "secret" && t.Mode != "p2p"
+				if autoPort {
+					key := fmt.Sprintf("%d_%s_%s", client.Id, t.Mode, t.Remark)
+					prefer, _ := s.autoPorts.Load(key)
+					port, _ := prefer.(int)
+					if port, err = tool.GetFreePort(t.Mode, port); err != nil {
+						logs.Warn("allocate the server port of the tunnel %s error %s", t.Remark, err.Error())
+						fail = true
+						c.WriteAddFail()
+						break loop
+					}
+					//the tunnel is added before the function returns
+					defer tool.ReleasePort(port)
+					s.autoPorts.Store(key, port)
+					ports = []int{port}
+				}
 				if len(ports) > 1 && (t.Mode == "tcp" || t.Mode == "udp") && (len(ports) != len(targets)) {
 					fail = true
 					c.WriteAddFail()
@@ -499,16 +547,31 @@ loop:
 						} else {
 							tl.Target.TargetStr = strconv.Itoa(targets[i])
 						}
+						tl.Target.ProxyProtocol = t.Target.ProxyProtocol
 					}
 					tl.Id = int(file.GetDb().JsonDb.GetTaskId())
 					tl.Status = true
 					tl.Flow = new(file.Flow)
+					if t.Flow != nil {
+						tl.Flow.FlowLimit = t.Flow.FlowLimit
+					}
 					tl.NoStore = true
 					tl.Client = client
 					tl.Password = t.Password
 					tl.LocalPath = t.LocalPath
 					tl.StripPre = t.StripPre
 					tl.MultiAccount = t.MultiAccount
+					tl.IpConnLimit = t.IpConnLimit
+					tl.DestAcl = t.DestAcl
+					tl.VisitorAllow = t.VisitorAllow
+					tl.VisitorDeny = t.VisitorDeny
+					tl.UdpTimeout = t.UdpTimeout
+					tl.UdpMaxSess = t.UdpMaxSess
+					tl.RateLimit = t.RateLimit
+					tl.InRateLimit = t.InRateLimit
+					tl.OutRateLimit = t.OutRateLimit
+					tl.RateBurst = t.RateBurst
+					tl.MaxConn = t.MaxConn
 					if !client.HasTunnel(tl) {
 						if err := file.GetDb().NewTask(tl); err != nil {
 							logs.Notice("Add task error ", err.Error())
@@ -525,6 +588,10 @@ loop:
 						}
 					}
 					c.WriteAddOk()
+					//tell the client the allocated port
+					if autoPort {
+						c.WriteLenContent([]byte(strconv.Itoa(tl.Port)))
+					}
 				}
 			}
 		}
@@ -19,6 +19,9 @@ import (
 	"ehang.io/nps/lib/crypt"
 )
 
+//the time to wait for the inbound connection of socks5 bind
+const bindTimeout = time.Minute * 2
+
 type TRPClient struct {
 	svrAddr        string
 	bridgeConnType string
@@ -181,10 +184,25 @@ func (s *TRPClient) handleChan(src net.Conn) {
 	lk.Host = common.FormatAddress(lk.Host)
 	//if Conn type is http, read the request and log
 	if lk.ConnType == "http" {
-		if targetConn, err := net.DialTimeout(common.CONN_TCP, lk.Host, lk.Option.Timeout); err != nil {
+		addr, isHttps := conn.SplitHttpsTarget(lk.Host)
+		if targetConn, err := net.DialTimeout(common.CONN_TCP, addr, lk.Option.Timeout); err != nil {
 			logs.Warn("connect to %s error %s", lk.Host, err.Error())
 			src.Close()
 		} else {
+			if lk.Option.ProxyProtocol > 0 {
+				common.WriteProxyProtocol(targetConn, lk.Option.ProxyProtocol, lk.RemoteAddr, targetConn.RemoteAddr())
+			}
+			//originate tls to the https target
+			if isHttps {
+				if tlsConn, err := conn.NewTlsTargetConn(targetConn, addr, lk.Option.Tls, lk.Option.Timeout); err != nil {
+					logs.Warn("tls handshake with %s error %s", lk.Host, err.Error())
+					targetConn.Close()
+					src.Close()
+					return
+				} else {
+					targetConn = tlsConn
+				}
+			}
 			srcConn := conn.GetConn(src, lk.Crypt, lk.Compress, nil, false)
 			go func() {
 				common.CopyBuffer(srcConn, targetConn)
@@ -204,6 +222,11 @@ func (s *TRPClient) handleChan(src net.Conn) {
 		}
 		return
 	}
+	if lk.ConnType == "bind" {
+		logs.Trace("new %s connection for %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
+		s.handleBind(src, lk)
+		return
+	}
 	if lk.ConnType == "udp5" {
 		logs.Trace("new %s connection with the goal of %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
 		s.handleUdp(src)
@@ -214,6 +237,10 @@ func (s *TRPClient) handleChan(src net.Conn) {
 		src.Close()
 	} else {
 		logs.Trace("new %s connection with the goal of %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
+		//tell the target the real address of the visitor
+		if lk.Option.ProxyProtocol > 0 && lk.ConnType == common.CONN_TCP {
+			common.WriteProxyProtocol(targetConn, lk.Option.ProxyProtocol, lk.RemoteAddr, targetConn.RemoteAddr())
+		}
 		conn.CopyWaitGroup(src, targetConn, lk.Crypt, lk.Compress, nil, nil, false, nil)
 	}
 }
@@ -277,6 +304,59 @@ func (s *TRPClient) handleUdp(serverConn net.Conn) {
 	}
 }
 
+//socks5 bind, listen on the internal side and relay the inbound connection from the host of the link
+func (s *TRPClient) handleBind(src net.Conn, lk *conn.Link) {
+	defer src.Close()
+	listener, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		logs.Warn("socks5 bind listen error %s", err.Error())
+		return
+	}
+	defer listener.Close()
+	c := conn.NewConn(src)
+	if err := c.WriteLenContent([]byte(s.bindAddr(lk.Host, listener.Addr().(*net.TCPAddr).Port))); err != nil {
+		return
+	}
+	listener.SetDeadline(time.Now().Add(bindTimeout))
+	host, _, _ := net.SplitHostPort(lk.Host)
+	ip := net.ParseIP(host)
+	for {
+		peer, err := listener.AcceptTCP()
+		if err != nil {
+			logs.Warn("socks5 bind for %s error %s", lk.Host, err.Error())
+			return
+		}
+		//only the host requested can connect if its ip is set
+		if ip != nil && !ip.IsUnspecified() && !ip.Equal(peer.RemoteAddr().(*net.TCPAddr).IP) {
+			logs.Warn("socks5 bind for %s, the connection from %s is refused", lk.Host, peer.RemoteAddr())
+			peer.Close()
+			continue
+		}
+		listener.Close()
+		if err := c.WriteLenContent([]byte(peer.RemoteAddr().String())); err != nil {
+			peer.Close()
+			return
+		}
+		conn.CopyWaitGroup(src, peer, lk.Crypt, lk.Compress, nil, nil, false, nil)
+		return
+	}
+}
+
+//the bound address replied to the visitor, the ip is the local one routed to the host which will connect,
+//or the one routed to the server if the host is not set
+func (s *TRPClient) bindAddr(addr string, port int) string {
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		addr = s.svrAddr
+	}
+	//no packet is sent by dialing udp
+	if c, err := net.Dial(common.CONN_UDP, addr); err == nil {
+		defer c.Close()
+		return net.JoinHostPort(c.LocalAddr().(*net.UDPAddr).IP.String(), strconv.Itoa(port))
+	}
+	return net.JoinHostPort(net.IPv4zero.String(), strconv.Itoa(port))
+}
+
 // Whether the monitor channel is closed
 func (s *TRPClient) ping() {
 	s.ticker = time.NewTicker(time.Second * 5)
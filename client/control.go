@@ -64,7 +64,7 @@ func GetTaskStatus(path string) {
 		}
 		for _, v := range cnf.Tasks {
 			ports := common.GetPorts(v.Ports)
-			if v.Mode == "secret" {
+			if v.Mode == "secret" || common.IsAutoPort(v.Ports) {
 				ports = append(ports, 0)
 			}
 			for _, vv := range ports {
@@ -158,6 +158,13 @@ re:
 			logs.Error(errAdd, v.Ports, v.Remark)
 			goto re
 		}
+		if common.IsAutoPort(v.Ports) && v.Mode != "secret" && v.Mode != "p2p" {
+			if b, err = c.GetShortLenContent(); err != nil {
+				logs.Error(err)
+				goto re
+			}
+			logs.Notice("the server port of the tunnel %s is %s", v.Remark, string(b))
+		}
 		if v.Mode == "file" {
 			//start local file server
 			go startLocalFileServer(cnf.CommonConfig, v, vkey)
@@ -0,0 +1,146 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+//formats of the access log
+const (
+	FormatCombined = "combined"
+	FormatJson     = "json"
+)
+
+//the access log of a request of the host proxy
+type Record struct {
+	Seq       int64     `json:"-"`
+	Time      time.Time `json:"time"`
+	RemoteIp  string    `json:"remote_ip"`
+	User      string    `json:"user,omitempty"`
+	Host      string    `json:"host"`
+	HostId    int       `json:"host_id"`
+	ClientId  int       `json:"client_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Target    string    `json:"target"`
+	Latency   float64   `json:"latency_ms"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+}
+
+//format the record, combined is the apache combined log format followed by the host, target, client id and latency
+func (r *Record) Format(format string) string {
+	if format == FormatJson {
+		b, _ := json.Marshal(r)
+		return string(b)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d "%s" "%s" "%s" "%s" %d %.3f`,
+		r.RemoteIp, dash(r.User), r.Time.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.Path, r.Proto,
+		r.Status, r.Bytes, dash(r.Referer), dash(r.UserAgent), r.Host, dash(r.Target), r.ClientId, r.Latency)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+var (
+	path       string
+	format     = FormatCombined
+	global     bool
+	maxSize    int64
+	maxBackups int
+	webSize    int
+	writers    = make(map[string]*Writer)
+	recent     = make(map[int][]*Record)
+	seq        int64
+	lock       sync.Mutex
+)
+
+//set the access log, path is the global log file and the log file of a host is access_<host id> in the same directory.
+//global means all hosts are logged to the global file, maxSize is the size in bytes before rotated.
+//webSize is the recent records of each host kept for the web, 0 means disabled
+func Init(logPath, logFormat string, logGlobal bool, logMaxSize int64, logMaxBackups, logWebSize int) {
+	lock.Lock()
+	defer lock.Unlock()
+	for _, w := range writers {
+		w.Close()
+	}
+	writers = make(map[string]*Writer)
+	path, format, global, maxSize, maxBackups, webSize = logPath, logFormat, logGlobal, logMaxSize, logMaxBackups, logWebSize
+}
+
+//whether the request of the host should be logged, hostLog is the access log setting of the host
+func Enabled(hostLog bool) bool {
+	return path != "" && (global || hostLog)
+}
+
+//write the record to the global log and the log of the host
+func Log(r *Record, hostLog bool) {
+	if !Enabled(hostLog) {
+		return
+	}
+	line := r.Format(format)
+	lock.Lock()
+	defer lock.Unlock()
+	if global {
+		write(path, line)
+	}
+	if hostLog && r.HostId > 0 {
+		ext := filepath.Ext(path)
+		write(strings.TrimSuffix(path, ext)+"_"+strconv.Itoa(r.HostId)+ext, line)
+	}
+	if webSize > 0 && r.HostId > 0 {
+		seq++
+		r.Seq = seq
+		arr := append(recent[r.HostId], r)
+		if len(arr) > webSize {
+			arr = arr[len(arr)-webSize:]
+		}
+		recent[r.HostId] = arr
+	}
+}
+
+func write(file, line string) {
+	w, ok := writers[file]
+	if !ok {
+		w = NewWriter(file, maxSize, maxBackups)
+		writers[file] = w
+	}
+	if err := w.WriteLine(line); err != nil {
+		logs.Warn("write access log %s error %s", file, err)
+	}
+}
+
+//get the recent records of the host after the seq, and the latest seq
+func Recent(hostId int, after int64) ([]*Record, int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	var arr []*Record
+	for _, r := range recent[hostId] {
+		if r.Seq > after {
+			arr = append(arr, r)
+		}
+	}
+	return arr, seq
+}
+
+//remove the recent records of the deleted host
+func Remove(hostId int) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(recent, hostId)
+}
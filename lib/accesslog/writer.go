@@ -0,0 +1,81 @@
+package accesslog
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+//a log file rotated by size, file.1 is the latest rotated one
+type Writer struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	f          *os.File
+	sync.Mutex
+}
+
+//create a writer, maxSize 0 means never rotated
+func NewWriter(path string, maxSize int64, maxBackups int) *Writer {
+	return &Writer{path: path, maxSize: maxSize, maxBackups: maxBackups}
+}
+
+//write a line to the file, rotate it if the size exceeds
+func (w *Writer) WriteLine(line string) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line))+1 > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.WriteString(line + "\n")
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.size = 0
+	if info, err := f.Stat(); err == nil {
+		w.size = info.Size()
+	}
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	w.f.Close()
+	w.f = nil
+	if w.maxBackups > 0 {
+		os.Remove(w.path + "." + strconv.Itoa(w.maxBackups))
+		for i := w.maxBackups - 1; i > 0; i-- {
+			os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+	return w.open()
+}
+
+//close the file
+func (w *Writer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,419 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the statuses which can be cached without explicit freshness, RFC 9110 section 15.1
+var heuristicStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+//the statuses understood by the cache
+var understoodStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 302: true, 307: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+//headers of the connection, not stored in the cache
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+//the heuristic freshness is at most one day
+const maxHeuristicLifetime = 24 * time.Hour
+
+// HttpCache is a shared http response cache following RFC 9111, limited by the total bytes of the responses.
+type HttpCache struct {
+	maxBytes  int64
+	maxObject int64
+	size      int64
+	lru       *Cache
+	sync.Mutex
+}
+
+// HttpEntry is a stored response.
+type HttpEntry struct {
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	vary         map[string]string
+	requestTime  time.Time
+	responseTime time.Time
+	lifetime     time.Duration
+	size         int64
+}
+
+//new a http cache, maxBytes is the total bytes limit of the responses and maxEntries is the num limit, 0 means no limit
+func NewHttpCache(maxEntries int, maxBytes int64) *HttpCache {
+	c := &HttpCache{
+		maxBytes:  maxBytes,
+		maxObject: maxBytes / 8,
+		lru:       New(maxEntries),
+	}
+	//a response is limited to 1/8 of the total bytes, no limit if the total bytes is not limited
+	if maxBytes <= 0 {
+		c.maxObject = math.MaxInt64
+	}
+	c.lru.OnEvicted = func(key Key, value interface{}) {
+		c.size -= value.(*HttpEntry).size
+	}
+	return c
+}
+
+//the max body size of a response which can be stored
+func (c *HttpCache) MaxObjectSize() int64 {
+	return c.maxObject
+}
+
+//the key is like http://host/path?query, the responses of http and https are stored separately
+func cacheKey(r *http.Request) string {
+	return r.URL.Scheme + "://" + strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+//get the stored response of the request, the entry may be stale and need validating
+func (c *HttpCache) Lookup(r *http.Request) *HttpEntry {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	if directives(r.Header).has("no-store") {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.lru.Get(cacheKey(r))
+	if !ok {
+		return nil
+	}
+	e := v.(*HttpEntry)
+	for k, val := range e.vary {
+		if r.Header.Get(k) != val {
+			return nil
+		}
+	}
+	return e
+}
+
+//whether the response of the request can be stored
+func (c *HttpCache) Storable(r *http.Request, resp *http.Response) bool {
+	if r.Method != http.MethodGet || !understoodStatus[resp.StatusCode] {
+		return false
+	}
+	reqCc, respCc := directives(r.Header), directives(resp.Header)
+	if reqCc.has("no-store") || respCc.has("no-store") || respCc.has("private") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !respCc.has("public") && !respCc.has("s-maxage") && !respCc.has("must-revalidate") {
+		return false
+	}
+	//the response for a visitor should not be shared with others
+	if resp.Header.Get("Set-Cookie") != "" || strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if resp.ContentLength > c.maxObject {
+		return false
+	}
+	if lifetime(resp.Header, resp.StatusCode, time.Now()) > 0 {
+		return true
+	}
+	//the stale response can still be validated
+	return resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+//store the response, the header should not be modified for the visitor yet
+func (c *HttpCache) Store(r *http.Request, resp *http.Response, body []byte, requestTime time.Time) {
+	if int64(len(body)) > c.maxObject {
+		return
+	}
+	e := &HttpEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		vary:         make(map[string]string),
+		requestTime:  requestTime,
+		responseTime: time.Now(),
+	}
+	for _, v := range hopHeaders {
+		e.Header.Del(v)
+	}
+	for _, v := range strings.Split(resp.Header.Get("Vary"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			e.vary[http.CanonicalHeaderKey(v)] = r.Header.Get(v)
+		}
+	}
+	e.lifetime = lifetime(e.Header, e.StatusCode, e.responseTime)
+	e.size = int64(len(body))
+	for k, v := range e.Header {
+		e.size += int64(len(k))
+		for _, val := range v {
+			e.size += int64(len(val))
+		}
+	}
+	c.add(cacheKey(r), e)
+}
+
+func (c *HttpCache) add(key string, e *HttpEntry) {
+	c.Lock()
+	defer c.Unlock()
+	c.lru.Remove(key)
+	c.lru.Add(key, e)
+	c.size += e.size
+	for c.maxBytes > 0 && c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.lru.RemoveOldest()
+	}
+}
+
+//update the stored response by the 304 response of validation, RFC 9111 section 4.3.4
+func (c *HttpCache) Update(r *http.Request, e *HttpEntry, resp *http.Response, requestTime time.Time) *HttpEntry {
+	n := *e
+	n.Header = e.Header.Clone()
+	for k, v := range resp.Header {
+		if k != "Content-Length" {
+			n.Header[k] = v
+		}
+	}
+	for _, v := range hopHeaders {
+		n.Header.Del(v)
+	}
+	n.requestTime = requestTime
+	n.responseTime = time.Now()
+	n.lifetime = lifetime(n.Header, n.StatusCode, n.responseTime)
+	c.add(cacheKey(r), &n)
+	return &n
+}
+
+//invalidate the stored response by the unsafe request, RFC 9111 section 4.4
+func (c *HttpCache) Invalidate(r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.lru.Remove(cacheKey(r))
+}
+
+//purge the stored responses of the host whose path begins with the path,
+//empty host means all hosts and the host like *.proxy.com matches all its sub domains
+func (c *HttpCache) Purge(host, path string) (num int) {
+	c.Lock()
+	defer c.Unlock()
+	host = strings.ToLower(host)
+	var keys []string
+	c.lru.cache.Range(func(key, value interface{}) bool {
+		k := key.(string)
+		if i := strings.Index(k, "://"); i > -1 {
+			k = k[i+3:]
+		}
+		i := strings.Index(k, "/")
+		if i < 0 {
+			i = len(k)
+		}
+		hostMatch := host == "" || k[:i] == host || (strings.HasPrefix(host, "*") && strings.HasSuffix(k[:i], host[1:]))
+		if hostMatch && strings.HasPrefix(k[i:], path) {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+	for _, k := range keys {
+		c.lru.Remove(k)
+	}
+	return len(keys)
+}
+
+//the current age of the entry, RFC 9111 section 4.2.3
+func (e *HttpEntry) age(now time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil && e.responseTime.After(date) {
+		apparentAge = e.responseTime.Sub(date)
+	}
+	ageValue, _ := strconv.Atoi(e.Header.Get("Age"))
+	correctedAge := time.Duration(ageValue)*time.Second + e.responseTime.Sub(e.requestTime)
+	if correctedAge < apparentAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.responseTime)
+}
+
+//whether the entry can be used for the request without validation
+func (e *HttpEntry) Fresh(r *http.Request) bool {
+	reqCc := directives(r.Header)
+	if reqCc.has("no-cache") || (len(reqCc) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache")) {
+		return false
+	}
+	if directives(e.Header).has("no-cache") {
+		return false
+	}
+	age := e.age(time.Now())
+	if v, ok := reqCc.seconds("max-age"); ok && age > v {
+		return false
+	}
+	if v, ok := reqCc.seconds("min-fresh"); ok {
+		age += v
+	}
+	return e.lifetime > age
+}
+
+//whether the entry has validators for conditional request
+func (e *HttpEntry) Validatable() bool {
+	return e.Header.Get("Etag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+//add the conditional headers to validate the entry, return false if the request has its own conditions
+func (e *HttpEntry) AddConditions(r *http.Request) bool {
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	if v := e.Header.Get("Etag"); v != "" {
+		r.Header.Set("If-None-Match", v)
+	}
+	if v := e.Header.Get("Last-Modified"); v != "" {
+		r.Header.Set("If-Modified-Since", v)
+	}
+	return true
+}
+
+//remove the conditional headers added by AddConditions
+func (e *HttpEntry) RemoveConditions(r *http.Request) {
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+}
+
+//build the response of the request from the entry, 304 if the conditions of request match the entry
+func (e *HttpEntry) Response(r *http.Request) *http.Response {
+	resp := &http.Response{
+		StatusCode:    e.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       r,
+		Header:        e.Header.Clone(),
+		ContentLength: int64(len(e.Body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(e.age(time.Now())/time.Second)))
+	if e.notModified(r) {
+		resp.StatusCode = http.StatusNotModified
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+func (e *HttpEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("Etag"), "W/")
+		for _, v := range strings.Split(inm, ",") {
+			if v = strings.TrimSpace(v); v == "*" || (etag != "" && strings.TrimPrefix(v, "W/") == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
+
+//the freshness lifetime of the response, RFC 9111 section 4.2.1 and 4.2.2
+func lifetime(header http.Header, status int, responseTime time.Time) time.Duration {
+	cc := directives(header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if v, ok := cc.seconds("s-maxage"); ok {
+		return v
+	}
+	if v, ok := cc.seconds("max-age"); ok {
+		return v
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = responseTime
+	}
+	if header.Get("Expires") != "" {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil || expires.Before(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil && heuristicStatus[status] && date.After(lm) {
+		if v := date.Sub(lm) / 10; v < maxHeuristicLifetime {
+			return v
+		}
+		return maxHeuristicLifetime
+	}
+	return 0
+}
+
+type cacheControl map[string]string
+
+//parse the Cache-Control header
+func directives(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, line := range header.Values("Cache-Control") {
+		for _, v := range strings.Split(line, ",") {
+			kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+			if kv[0] == "" {
+				continue
+			}
+			if len(kv) == 2 {
+				cc[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			} else {
+				cc[strings.ToLower(kv[0])] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// BodyRecorder records the body read from the response, up to the max size.
+type BodyRecorder struct {
+	io.ReadCloser
+	buf      []byte
+	max      int64
+	overflow bool
+}
+
+func NewBodyRecorder(rc io.ReadCloser, max int64) *BodyRecorder {
+	return &BodyRecorder{ReadCloser: rc, max: max}
+}
+
+func (s *BodyRecorder) Read(p []byte) (n int, err error) {
+	n, err = s.ReadCloser.Read(p)
+	if !s.overflow {
+		if int64(len(s.buf)+n) > s.max {
+			s.overflow, s.buf = true, nil
+		} else {
+			s.buf = append(s.buf, p[:n]...)
+		}
+	}
+	return
+}
+
+//the recorded body, false if it's larger than the max size
+func (s *BodyRecorder) Bytes() ([]byte, bool) {
+	return s.buf, !s.overflow
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newResponse(header map[string]string) *http.Response {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	for k, v := range header {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
+
+func httpTime(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+func TestHttpCacheFresh(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		header map[string]string
+		fresh  bool
+	}{
+		{map[string]string{"Cache-Control": "max-age=60"}, true},
+		{map[string]string{"Cache-Control": "max-age=60", "Age": "100"}, false},
+		{map[string]string{"Cache-Control": "s-maxage=60, max-age=0"}, true},
+		{map[string]string{"Cache-Control": "max-age=60, no-cache"}, false},
+		{map[string]string{"Date": httpTime(now), "Expires": httpTime(now.Add(time.Minute))}, true},
+		{map[string]string{"Date": httpTime(now), "Expires": httpTime(now.Add(-time.Minute))}, false},
+		{map[string]string{"Expires": "0"}, false},
+		//the heuristic freshness is 1/10 of the time since last modified
+		{map[string]string{"Date": httpTime(now), "Last-Modified": httpTime(now.Add(-time.Hour))}, true},
+		{map[string]string{"Date": httpTime(now), "Last-Modified": httpTime(now.Add(-time.Second))}, false},
+	}
+	for i, c := range cases {
+		hc := NewHttpCache(0, 0)
+		r, _ := http.NewRequest("GET", "http://a.proxy.com/a", nil)
+		hc.Store(r, newResponse(c.header), []byte("a"), now)
+		e := hc.Lookup(r)
+		if e == nil {
+			t.Fatalf("case %d, the response is not stored", i)
+		}
+		if e.Fresh(r) != c.fresh {
+			t.Fatalf("case %d, fresh should be %v", i, c.fresh)
+		}
+	}
+
+	hc := NewHttpCache(0, 0)
+	r, _ := http.NewRequest("GET", "http://a.proxy.com/a", nil)
+	hc.Store(r, newResponse(map[string]string{"Cache-Control": "max-age=60"}), []byte("a"), now)
+	e := hc.Lookup(r)
+	for _, v := range []string{"no-cache", "max-age=0", "min-fresh=120"} {
+		r.Header.Set("Cache-Control", v)
+		if e.Fresh(r) {
+			t.Fatalf("the request with %s should not use the fresh response", v)
+		}
+	}
+	r.Header.Del("Cache-Control")
+	r.Header.Set("Pragma", "no-cache")
+	if e.Fresh(r) {
+		t.Fatal("the request with pragma no-cache should not use the fresh response")
+	}
+}
+
+func TestHttpCacheVary(t *testing.T) {
+	hc := NewHttpCache(0, 0)
+	r, _ := http.NewRequest("GET", "http://a.proxy.com/a", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	hc.Store(r, newResponse(map[string]string{"Cache-Control": "max-age=60", "Vary": "accept-encoding"}), []byte("a"), time.Now())
+	if hc.Lookup(r) == nil {
+		t.Fatal("the request with the same header should match")
+	}
+	r.Header.Set("Accept-Encoding", "br")
+	if hc.Lookup(r) != nil {
+		t.Fatal("the request with a different header should not match")
+	}
+	r.Header.Del("Accept-Encoding")
+	if hc.Lookup(r) != nil {
+		t.Fatal("the request without the header should not match")
+	}
+	if hc.Storable(r, newResponse(map[string]string{"Cache-Control": "max-age=60", "Vary": "*"})) {
+		t.Fatal("vary * should not be stored")
+	}
+}
+
+func TestHttpCacheStorable(t *testing.T) {
+	hc := NewHttpCache(0, 0)
+	r, _ := http.NewRequest("GET", "http://a.proxy.com/a", nil)
+	cases := []struct {
+		header   map[string]string
+		storable bool
+	}{
+		{map[string]string{"Cache-Control": "max-age=60"}, true},
+		{map[string]string{"Etag": `"1"`}, true},
+		{map[string]string{}, false},
+		{map[string]string{"Cache-Control": "no-store"}, false},
+		{map[string]string{"Cache-Control": "private, max-age=60"}, false},
+		{map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=1"}, false},
+	}
+	for i, c := range cases {
+		if hc.Storable(r, newResponse(c.header)) != c.storable {
+			t.Fatalf("case %d, storable should be %v", i, c.storable)
+		}
+	}
+	r.Header.Set("Authorization", "Basic YTpi")
+	if hc.Storable(r, newResponse(map[string]string{"Cache-Control": "max-age=60"})) {
+		t.Fatal("the response of the authorized request should not be stored")
+	}
+	if !hc.Storable(r, newResponse(map[string]string{"Cache-Control": "public, max-age=60"})) {
+		t.Fatal("the public response of the authorized request should be stored")
+	}
+	r.Header.Del("Authorization")
+	//no limit of the object size if the total size is not limited
+	resp := newResponse(map[string]string{"Cache-Control": "max-age=60"})
+	resp.ContentLength = 1 << 30
+	if !hc.Storable(r, resp) {
+		t.Fatal("the large response should be stored without size limit")
+	}
+	if NewHttpCache(0, 1<<20).Storable(r, resp) {
+		t.Fatal("the large response should not be stored")
+	}
+}
+
+func TestHttpCacheValidate(t *testing.T) {
+	hc := NewHttpCache(0, 0)
+	r, _ := http.NewRequest("GET", "http://a.proxy.com/a", nil)
+	hc.Store(r, newResponse(map[string]string{"Etag": `"1"`, "Cache-Control": "max-age=0"}), []byte("a"), time.Now())
+	e := hc.Lookup(r)
+	if e.Fresh(r) || !e.Validatable() || !e.AddConditions(r) || r.Header.Get("If-None-Match") != `"1"` {
+		t.Fatal("the stale response should be validated by etag")
+	}
+	e = hc.Update(r, e, newResponse(map[string]string{"Cache-Control": "max-age=60"}), time.Now())
+	e.RemoveConditions(r)
+	if !hc.Lookup(r).Fresh(r) || string(e.Body) != "a" {
+		t.Fatal("the response should be fresh after validated")
+	}
+	r.Header.Set("If-None-Match", `W/"1"`)
+	if e.Response(r).StatusCode != http.StatusNotModified {
+		t.Fatal("the conditional request should get 304")
+	}
+}
+
+func TestHttpCacheKey(t *testing.T) {
+	hc := NewHttpCache(0, 0)
+	r, _ := http.NewRequest("GET", "http://a.proxy.com/a", nil)
+	hc.Store(r, newResponse(map[string]string{"Cache-Control": "max-age=60"}), []byte("a"), time.Now())
+	r2, _ := http.NewRequest("GET", "https://a.proxy.com/a", nil)
+	if hc.Lookup(r2) != nil {
+		t.Fatal("the response of http should not be used by https")
+	}
+	hc.Store(r2, newResponse(map[string]string{"Cache-Control": "max-age=60"}), []byte("a"), time.Now())
+	r3, _ := http.NewRequest("GET", "http://b.proxy.com/b", nil)
+	hc.Store(r3, newResponse(map[string]string{"Cache-Control": "max-age=60"}), []byte("a"), time.Now())
+	if n := hc.Purge("a.proxy.com", "/"); n != 2 {
+		t.Fatalf("purge %d responses, want 2", n)
+	}
+	if n := hc.Purge("*.proxy.com", ""); n != 1 {
+		t.Fatalf("purge %d responses, want 1", n)
+	}
+}
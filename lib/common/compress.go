@@ -0,0 +1,125 @@
+package common
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+//content types compressed when the host does not set them, type/* matches all subtypes
+const DefaultCompressTypes = "text/*,application/javascript,application/x-javascript,application/json,application/xml,application/wasm,image/svg+xml"
+
+//responses smaller than this are not worth compressing
+const compressMinSize = 1024
+
+//choose the content coding from the Accept-Encoding of the visitor, allowed is the codings
+//enabled by the host in order of preference, eg: br,gzip. only gzip and br are supported,
+//return empty if none is acceptable
+func NegotiateEncoding(acceptEncoding, allowed string) string {
+	if acceptEncoding == "" || allowed == "" {
+		return ""
+	}
+	qs := make(map[string]float64)
+	for _, v := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		qs[name] = q
+	}
+	var best string
+	var bestQ float64
+	for _, v := range strings.Split(allowed, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "gzip" && v != "br" {
+			continue
+		}
+		q, ok := qs[v]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = v, q
+		}
+	}
+	return best
+}
+
+//check whether the response can be compressed, types is the compressible content types separated by comma
+func IsCompressible(r *http.Request, resp *http.Response, types string) bool {
+	if r.Method == http.MethodHead || !r.ProtoAtLeast(1, 1) {
+		return false
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	if resp.Header.Get("Content-Range") != "" || strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < compressMinSize {
+		return false
+	}
+	ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	//the event stream must be flushed in time
+	if err != nil || ct == "text/event-stream" {
+		return false
+	}
+	if types == "" {
+		types = DefaultCompressTypes
+	}
+	for _, v := range strings.Split(types, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == ct || (strings.HasSuffix(v, "/*") && strings.HasPrefix(ct, v[:len(v)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+//compress the body of the response with the encoding, gzip or br.
+//the response is sent chunked and the strong etag is weakened since the bytes changed
+func CompressResponse(resp *http.Response, encoding string) {
+	pr, pw := io.Pipe()
+	body := resp.Body
+	go func() {
+		var w io.WriteCloser
+		if encoding == "br" {
+			w = brotli.NewWriter(pw)
+		} else {
+			w = gzip.NewWriter(pw)
+		}
+		_, err := io.Copy(w, body)
+		if err == nil {
+			err = w.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", encoding)
+	if resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if !strings.Contains(strings.ToLower(strings.Join(resp.Header.Values("Vary"), ",")), "accept-encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+}
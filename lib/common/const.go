@@ -35,4 +35,9 @@ WWW-Authenticate: Basic realm="easyProxy"
 	ConnectionFailBytes = `HTTP/1.1 404 Not Found
 
 `
+	ForbiddenBytes = `HTTP/1.1 403 Forbidden
+Content-Type: text/plain; charset=utf-8
+Connection: close
+
+403 Forbidden`
 )
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the time waiting for the PROXY protocol header, the address of the connection is used if no data arrives
+var proxyProtocolTimeout = 3 * time.Second
+
+//the signature of the PROXY protocol v2 header
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//build the PROXY protocol header of the version 1 or 2, src is the address of the visitor and dst is the address it connected to.
+//the UNKNOWN or LOCAL header is built if the address is not a tcp address
+func ProxyProtocolHeader(version int, src, dst net.Addr) []byte {
+	srcAddr, ok1 := src.(*net.TCPAddr)
+	dstAddr, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2 && srcAddr != nil && dstAddr != nil && srcAddr.IP != nil && dstAddr.IP != nil
+	var srcIp, dstIp net.IP
+	if known {
+		//both addresses must be the same family
+		if srcIp, dstIp = srcAddr.IP.To4(), dstAddr.IP.To4(); srcIp == nil || dstIp == nil {
+			srcIp, dstIp = srcAddr.IP.To16(), dstAddr.IP.To16()
+		}
+	}
+	if version == 2 {
+		header := append([]byte{}, proxyProtocolV2Sig...)
+		if !known {
+			//LOCAL command with unspecified family
+			return append(header, 0x20, 0x00, 0x00, 0x00)
+		}
+		family := byte(0x11)
+		if len(srcIp) == net.IPv6len {
+			family = 0x21
+		}
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(srcIp)*2+4))
+		header = append(header, 0x21, family)
+		header = append(header, length...)
+		header = append(header, srcIp...)
+		header = append(header, dstIp...)
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, uint16(srcAddr.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+		return append(header, ports...)
+	}
+	if !known {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto, srcStr, dstStr := "TCP4", srcIp.String(), dstIp.String()
+	if len(srcIp) == net.IPv6len {
+		proto = "TCP6"
+		//the ipv4 address is mapped when the other one is ipv6
+		if srcIp.To4() != nil {
+			srcStr = "::ffff:" + srcStr
+		}
+		if dstIp.To4() != nil {
+			dstStr = "::ffff:" + dstStr
+		}
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcStr, dstStr, srcAddr.Port, dstAddr.Port))
+}
+
+//write the PROXY protocol header to the target, remoteAddr is the address of the visitor, eg: Link.RemoteAddr
+func WriteProxyProtocol(w io.Writer, version int, remoteAddr string, dst net.Addr) error {
+	var src net.Addr
+	if host, port, err := net.SplitHostPort(remoteAddr); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			src = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+		}
+	}
+	_, err := w.Write(ProxyProtocolHeader(version, src, dst))
+	return err
+}
+
+var (
+	proxyProtocolTrusted     []*net.IPNet
+	proxyProtocolTrustedLock sync.RWMutex
+)
+
+//set the sources trusted to send the PROXY protocol header, eg: 10.0.0.0/8,192.168.1.2
+func SetProxyProtocolTrusted(s string) error {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	proxyProtocolTrustedLock.Lock()
+	proxyProtocolTrusted = nets
+	proxyProtocolTrustedLock.Unlock()
+	return nil
+}
+
+//whether the address is trusted to send the PROXY protocol header
+func IsProxyProtocolTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	proxyProtocolTrustedLock.RLock()
+	defer proxyProtocolTrustedLock.RUnlock()
+	for _, v := range proxyProtocolTrusted {
+		if v.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//the listener parses the PROXY protocol header of the connections from the trusted sources
+type ProxyProtocolListener struct {
+	net.Listener
+}
+
+//wrap the listener, the connections from the untrusted sources are not changed
+func NewProxyProtocolListener(l net.Listener) net.Listener {
+	return &ProxyProtocolListener{Listener: l}
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil || !IsProxyProtocolTrusted(c.RemoteAddr()) {
+		return c, err
+	}
+	return NewProxyProtocolConn(c), nil
+}
+
+//the connection with the PROXY protocol header parsed, the header is parsed at the first read or remote address
+//within a short timeout. the data is not changed if there is no header
+type ProxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func NewProxyProtocolConn(c net.Conn) *ProxyProtocolConn {
+	return &ProxyProtocolConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *ProxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.parse)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.parse)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyProtocolConn) parse() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	b, err := c.r.Peek(1)
+	if err != nil {
+		//nothing is sent in time, eg: the server speaks first, the data read later is not changed
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			c.err = err
+		}
+		return
+	}
+	switch b[0] {
+	case 'P':
+		if b, err = c.r.Peek(6); err == nil && string(b) == "PROXY " {
+			c.remoteAddr, c.err = c.parseV1()
+		}
+	case proxyProtocolV2Sig[0]:
+		if b, err = c.r.Peek(len(proxyProtocolV2Sig)); err == nil && bytes.Equal(b, proxyProtocolV2Sig) {
+			c.remoteAddr, c.err = c.parseV2()
+		}
+	}
+}
+
+//PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n, at most 107 bytes
+func (c *ProxyProtocolConn) parseV1() (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, errors.New("the PROXY protocol v1 header is too long")
+		}
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid PROXY protocol v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func (c *ProxyProtocolConn) parseV2() (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("invalid PROXY protocol v2 version")
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	//LOCAL command, the address of the connection is used
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11:
+		if len(data) >= 12 {
+			return &net.TCPAddr{IP: net.IP(data[:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+		}
+	case 0x21:
+		if len(data) >= 36 {
+			return &net.TCPAddr{IP: net.IP(data[:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+		}
+	default:
+		//unsupported family such as udp or unix
+		return nil, nil
+	}
+	return nil, errors.New("invalid PROXY protocol v2 address")
+}
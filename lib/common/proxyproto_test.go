@@ -0,0 +1,134 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4Src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	v4Dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	v6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	cases := []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{v4Src, v4Dst, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"},
+		{v4Src, v6Dst, "PROXY TCP6 ::ffff:192.168.0.1 2001:db8::1 56324 443\r\n"},
+		{nil, v4Dst, "PROXY UNKNOWN\r\n"},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}, v4Dst, "PROXY UNKNOWN\r\n"},
+	}
+	for _, c := range cases {
+		if got := string(ProxyProtocolHeader(1, c.src, c.dst)); got != c.want {
+			t.Fatalf("got %q, want %q", got, c.want)
+		}
+	}
+
+	b := ProxyProtocolHeader(2, v4Src, v4Dst)
+	want := append(append([]byte{}, proxyProtocolV2Sig...), 0x21, 0x11, 0x00, 0x0c, 192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb)
+	if !bytes.Equal(b, want) {
+		t.Fatalf("got %x, want %x", b, want)
+	}
+	if b = ProxyProtocolHeader(2, v4Src, v6Dst); len(b) != 16+36 || b[13] != 0x21 {
+		t.Fatalf("the mixed addresses should be ipv6, got %x", b)
+	}
+	want = append(append([]byte{}, proxyProtocolV2Sig...), 0x20, 0x00, 0x00, 0x00)
+	if b = ProxyProtocolHeader(2, nil, v4Dst); !bytes.Equal(b, want) {
+		t.Fatalf("got %x, want LOCAL %x", b, want)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteProxyProtocol(buf, 1, "192.168.0.1:56324", v4Dst); err != nil || buf.String() != "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n" {
+		t.Fatalf("got %q %v", buf.String(), err)
+	}
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	v4Src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	v6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 56324}
+	v4Dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	v6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	cases := []struct {
+		header []byte
+		addr   string //empty means the address of the connection
+		err    bool
+	}{
+		{ProxyProtocolHeader(1, v4Src, v4Dst), "192.168.0.1:56324", false},
+		{ProxyProtocolHeader(1, v6Src, v6Dst), "[2001:db8::2]:56324", false},
+		{ProxyProtocolHeader(1, nil, nil), "", false},
+		{ProxyProtocolHeader(2, v4Src, v4Dst), "192.168.0.1:56324", false},
+		{ProxyProtocolHeader(2, v6Src, v6Dst), "[2001:db8::2]:56324", false},
+		{ProxyProtocolHeader(2, nil, nil), "", false},
+		{nil, "", false},
+		{[]byte("PROXY TCP4 a b 1 2\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n"), "", true},
+		{append([]byte("PROXY "), bytes.Repeat([]byte("a"), 120)...), "", true},
+	}
+	for i, c := range cases {
+		client, server := net.Pipe()
+		go func(header []byte) {
+			client.Write(append(header, "GET / HTTP/1.1\r\n"...))
+			client.Close()
+		}(append([]byte{}, c.header...))
+		pc := NewProxyProtocolConn(server)
+		addr := pc.RemoteAddr().String()
+		b := make([]byte, 3)
+		_, err := pc.Read(b)
+		if c.err {
+			if err == nil {
+				t.Fatalf("case %d, the header should be invalid", i)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil || string(b) != "GET" {
+			t.Fatalf("case %d, got %q %v, the data after the header should not be changed", i, b, err)
+		}
+		if c.addr == "" {
+			c.addr = server.RemoteAddr().String()
+		}
+		if addr != c.addr {
+			t.Fatalf("case %d, got address %s, want %s", i, addr, c.addr)
+		}
+		server.Close()
+	}
+}
+
+func TestProxyProtocolTimeout(t *testing.T) {
+	proxyProtocolTimeout = 50 * time.Millisecond
+	defer func() { proxyProtocolTimeout = 3 * time.Second }()
+	client, server := net.Pipe()
+	defer client.Close()
+	pc := NewProxyProtocolConn(server)
+	start := time.Now()
+	if addr := pc.RemoteAddr().String(); addr != server.RemoteAddr().String() {
+		t.Fatalf("got address %s, want the address of the connection", addr)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the remote address should not wait for the header")
+	}
+	//the data sent after the timeout is not changed
+	go client.Write([]byte("GET"))
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(pc, b); err != nil || string(b) != "GET" {
+		t.Fatalf("got %q %v", b, err)
+	}
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	if err := SetProxyProtocolTrusted("10.0.0.0/8, 192.168.1.2,2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetProxyProtocolTrusted("")
+	for ip, trusted := range map[string]bool{"10.1.2.3": true, "192.168.1.2": true, "192.168.1.3": false, "2001:db8::1": true, "2001:db8::2": false} {
+		if IsProxyProtocolTrusted(&net.TCPAddr{IP: net.ParseIP(ip)}) != trusted {
+			t.Fatalf("%s trusted should be %v", ip, trusted)
+		}
+	}
+	if SetProxyProtocolTrusted("10.0.0.0/33") == nil {
+		t.Fatal("the invalid cidr should be rejected")
+	}
+}
@@ -51,24 +51,30 @@ func DomainCheck(domain string) bool {
 
 //Check if the Request request is validated
 func CheckAuth(r *http.Request, user, passwd string) bool {
+	u, p, ok := GetAuth(r)
+	return ok && u == user && p == passwd
+}
+
+//get the username and password of the basic auth from the Authorization or Proxy-Authorization header
+func GetAuth(r *http.Request) (user, passwd string, ok bool) {
 	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 	if len(s) != 2 {
 		s = strings.SplitN(r.Header.Get("Proxy-Authorization"), " ", 2)
 		if len(s) != 2 {
-			return false
+			return
 		}
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		return false
+		return
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return false
+		return
 	}
-	return pair[0] == user && pair[1] == passwd
+	return pair[0], pair[1], true
 }
 
 //get bool by str
@@ -123,6 +129,73 @@ func ChangeHostAndHeader(r *http.Request, host string, header string, addr strin
 	}
 }
 
+//Change headers of response, one rule per line, "name: value" to set, "+name: value" to add and "-name" to remove
+func ChangeResponseHeader(header http.Header, change string) {
+	if change == "" {
+		return
+	}
+	for _, v := range strings.Split(change, "\n") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.HasPrefix(v, "-") {
+			header.Del(strings.TrimSpace(v[1:]))
+			continue
+		}
+		hd := strings.SplitN(strings.TrimPrefix(v, "+"), ":", 2)
+		if len(hd) != 2 {
+			continue
+		}
+		if strings.HasPrefix(v, "+") {
+			header.Add(strings.TrimSpace(hd[0]), strings.TrimSpace(hd[1]))
+		} else {
+			header.Set(strings.TrimSpace(hd[0]), strings.TrimSpace(hd[1]))
+		}
+	}
+}
+
+//whether the request is a cors preflight request
+func IsCorsPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+//Set cors headers of response if the origin of request is allowed, allowOrigins is * or origins separated by comma
+func SetCorsHeader(header http.Header, r *http.Request, allowOrigins string) bool {
+	origin := r.Header.Get("Origin")
+	if allowOrigins == "" || origin == "" {
+		return false
+	}
+	var allowed, exact bool
+	for _, v := range strings.Split(allowOrigins, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			allowed = true
+		} else if strings.EqualFold(strings.TrimSuffix(v, "/"), origin) {
+			allowed, exact = true, true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	header.Add("Vary", "Origin")
+	if exact {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+	if IsCorsPreflight(r) {
+		header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS")
+		if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+			header.Set("Access-Control-Allow-Headers", h)
+		}
+		header.Set("Access-Control-Max-Age", "86400")
+	}
+	return true
+}
+
 //Read file content by file path
 func ReadAllFromFile(filePath string) ([]byte, error) {
 	f, err := os.Open(filePath)
@@ -236,6 +309,12 @@ func GetPorts(p string) []int {
 	return ps
 }
 
+//whether the server port should be allocated by nps, eg server_port=auto
+func IsAutoPort(p string) bool {
+	p = strings.TrimSpace(p)
+	return p == "0" || strings.EqualFold(p, "auto")
+}
+
 //is the string a port
 func IsPort(p string) bool {
 	pi, err := strconv.Atoi(p)
@@ -87,10 +87,19 @@ func NewConfig(path string) (c *Config, err error) {
 				if strings.Index(nowContent, "host") > -1 {
 					h := dealHost(nowContent)
 					h.Remark = getTitleContent(c.title[i])
+					if _, err = file.ParseRouteRules(h.RouteRules); err != nil {
+						return nil, errors.New(fmt.Sprintf("host %s: %s", h.Remark, err.Error()))
+					}
 					c.Hosts = append(c.Hosts, h)
 				} else {
 					t := dealTunnel(nowContent)
 					t.Remark = getTitleContent(c.title[i])
+					if _, err = file.ParseAclRules(t.DestAcl); err != nil {
+						return nil, errors.New(fmt.Sprintf("tunnel %s: %s", t.Remark, err.Error()))
+					}
+					if _, err = file.ParseVisitorRules(t.VisitorAllow + "," + t.VisitorDeny); err != nil {
+						return nil, errors.New(fmt.Sprintf("tunnel %s: %s", t.Remark, err.Error()))
+					}
 					c.Tasks = append(c.Tasks, t)
 				}
 			}
@@ -140,6 +149,12 @@ func dealCommon(s string) *CommonConfig {
 			c.ProxyUrl = item[1]
 		case "rate_limit":
 			c.Client.RateLimit = common.GetIntNoErrByStr(item[1])
+		case "in_rate_limit":
+			c.Client.InRateLimit = common.GetIntNoErrByStr(item[1])
+		case "out_rate_limit":
+			c.Client.OutRateLimit = common.GetIntNoErrByStr(item[1])
+		case "rate_burst":
+			c.Client.RateBurst = common.GetIntNoErrByStr(item[1])
 		case "flow_limit":
 			c.Client.Flow.FlowLimit = int64(common.GetIntNoErrByStr(item[1]))
 		case "max_conn":
@@ -161,7 +176,7 @@ func dealHost(s string) *file.Host {
 	h.Scheme = "all"
 	var headerChange string
 	for _, v := range splitStr(s) {
-		item := strings.Split(v, "=")
+		item := strings.SplitN(v, "=", 2)
 		if len(item) == 0 {
 			continue
 		} else if len(item) == 1 {
@@ -178,7 +193,71 @@ func dealHost(s string) *file.Host {
 			h.Scheme = item[1]
 		case "location":
 			h.Location = item[1]
+		case "force_https":
+			h.ForceHttps = common.GetBoolByStr(item[1])
+		case "hsts_max_age":
+			h.HstsMaxAge = common.GetIntNoErrByStr(item[1])
+		case "lb_strategy":
+			h.Target.Strategy = item[1]
+		case "proxy_protocol":
+			h.Target.ProxyProtocol = common.GetIntNoErrByStr(item[1])
+		case "tls_server_name":
+			h.Target.TlsServerName = item[1]
+		case "tls_skip_verify":
+			h.Target.TlsSkipVerify = common.GetBoolByStr(item[1])
+		case "tls_ca":
+			h.Target.TlsCa = item[1]
+		case "tls_cert":
+			h.Target.TlsCert = item[1]
+		case "tls_key":
+			h.Target.TlsKey = item[1]
+		case "cors_origin":
+			h.CorsOrigin = item[1]
+		case "no_cache":
+			h.NoCache = common.GetBoolByStr(item[1])
+		case "compression":
+			h.Compression = item[1]
+		case "compress_type":
+			h.CompressType = item[1]
+		case "access_log":
+			h.AccessLog = common.GetBoolByStr(item[1])
+		case "inspect":
+			h.Inspect = common.GetBoolByStr(item[1])
+		case "ip_rate_limit":
+			h.IpRateLimit = common.GetIntNoErrByStr(item[1])
+		case "ip_rate_burst":
+			h.IpRateBurst = common.GetIntNoErrByStr(item[1])
+		case "flow_limit":
+			h.Flow = &file.Flow{FlowLimit: int64(common.GetIntNoErrByStr(item[1]))}
+		case "rate_limit":
+			h.RateLimit = common.GetIntNoErrByStr(item[1])
+		case "in_rate_limit":
+			h.InRateLimit = common.GetIntNoErrByStr(item[1])
+		case "out_rate_limit":
+			h.OutRateLimit = common.GetIntNoErrByStr(item[1])
+		case "rate_burst":
+			h.RateBurst = common.GetIntNoErrByStr(item[1])
+		case "max_conn":
+			h.MaxConn = common.GetIntNoErrByStr(item[1])
+		case "error_page":
+			//the file of the error page template
+			if b, err := common.ReadAllFromFile(item[1]); err == nil {
+				h.ErrorPage = string(b)
+			}
 		default:
+			if strings.HasPrefix(item[0], "resp_header_") {
+				//an empty value means removing the header
+				if name := strings.TrimPrefix(item[0], "resp_header_"); item[1] == "" {
+					h.RespHeader += "-" + name + "\n"
+				} else {
+					h.RespHeader += name + ":" + item[1] + "\n"
+				}
+				continue
+			}
+			if strings.HasPrefix(item[0], "route_") {
+				h.RouteRules += item[1] + "\n"
+				continue
+			}
 			if strings.Contains(item[0], "header") {
 				headerChange += strings.Replace(item[0], "header_", "", -1) + ":" + item[1] + "\n"
 			}
@@ -219,7 +298,7 @@ func dealTunnel(s string) *file.Tunnel {
 	t := &file.Tunnel{}
 	t.Target = new(file.Target)
 	for _, v := range splitStr(s) {
-		item := strings.Split(v, "=")
+		item := strings.SplitN(v, "=", 2)
 		if len(item) == 0 {
 			continue
 		} else if len(item) == 1 {
@@ -234,6 +313,32 @@ func dealTunnel(s string) *file.Tunnel {
 			t.Mode = item[1]
 		case "target_addr":
 			t.Target.TargetStr = strings.Replace(item[1], ",", "\n", -1)
+		case "lb_strategy":
+			t.Target.Strategy = item[1]
+		case "proxy_protocol":
+			t.Target.ProxyProtocol = common.GetIntNoErrByStr(item[1])
+		case "ip_conn_limit":
+			t.IpConnLimit = common.GetIntNoErrByStr(item[1])
+		case "visitor_allow":
+			t.VisitorAllow = item[1]
+		case "visitor_deny":
+			t.VisitorDeny = item[1]
+		case "udp_timeout":
+			t.UdpTimeout = common.GetIntNoErrByStr(item[1])
+		case "udp_max_sess":
+			t.UdpMaxSess = common.GetIntNoErrByStr(item[1])
+		case "flow_limit":
+			t.Flow = &file.Flow{FlowLimit: int64(common.GetIntNoErrByStr(item[1]))}
+		case "rate_limit":
+			t.RateLimit = common.GetIntNoErrByStr(item[1])
+		case "in_rate_limit":
+			t.InRateLimit = common.GetIntNoErrByStr(item[1])
+		case "out_rate_limit":
+			t.OutRateLimit = common.GetIntNoErrByStr(item[1])
+		case "rate_burst":
+			t.RateBurst = common.GetIntNoErrByStr(item[1])
+		case "max_conn":
+			t.MaxConn = common.GetIntNoErrByStr(item[1])
 		case "target_port":
 			t.Target.TargetStr = item[1]
 		case "target_ip":
@@ -257,6 +362,10 @@ func dealTunnel(s string) *file.Tunnel {
 					}
 				}
 			}
+		default:
+			if strings.HasPrefix(item[0], "acl_") {
+				t.DestAcl += item[1] + "\n"
+			}
 		}
 	}
 	return t
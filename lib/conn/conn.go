@@ -151,6 +151,8 @@ func (s *Conn) SetAlive(tp string) {
 		//conn.SetKeepAlivePeriod(time.Duration(2 * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Time{})
+	case *common.ProxyProtocolConn:
+		s.Conn.(*common.ProxyProtocolConn).SetReadDeadline(time.Time{})
 	}
 }
 
@@ -163,6 +165,8 @@ func (s *Conn) SetReadDeadlineBySecond(t time.Duration) {
 		s.Conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *common.ProxyProtocolConn:
+		s.Conn.(*common.ProxyProtocolConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	}
 }
 
@@ -429,3 +433,62 @@ func (c *LenConn) Write(p []byte) (n int, err error) {
 	c.Len += n
 	return
 }
+
+//report whether the first read of the connection gets data,
+//npc closes the connection without any data when it can not connect to the target.
+//nothing is reported if the connection is closed by ourselves or the visitor is closed first
+type FirstReadConn struct {
+	net.Conn
+	once   sync.Once
+	report func(ok bool)
+}
+
+func NewFirstReadConn(conn net.Conn, report func(ok bool)) *FirstReadConn {
+	return &FirstReadConn{Conn: conn, report: report}
+}
+
+func (s *FirstReadConn) Read(b []byte) (n int, err error) {
+	n, err = s.Conn.Read(b)
+	if n > 0 {
+		s.once.Do(func() { s.report(true) })
+	} else if err != nil {
+		s.once.Do(func() { s.report(false) })
+	}
+	return
+}
+
+//the connection closed by ourselves is not reported
+func (s *FirstReadConn) Close() error {
+	s.once.Do(func() {})
+	return s.Conn.Close()
+}
+
+//the visitor is closed, the target closed after it is not a failure
+func (s *FirstReadConn) Cancel() {
+	s.once.Do(func() {})
+}
+
+//cancel the report of the target when the visitor is closed
+func CancelReport(target net.Conn) {
+	if c, ok := target.(*FirstReadConn); ok {
+		c.Cancel()
+	}
+}
+
+//call the function once when the read of the connection fails, eg: the visitor closes the connection
+type ReadErrConn struct {
+	net.Conn
+	once sync.Once
+	f    func()
+}
+
+func NewReadErrConn(conn net.Conn, f func()) *ReadErrConn {
+	return &ReadErrConn{Conn: conn, f: f}
+}
+
+func (s *ReadErrConn) Read(b []byte) (n int, err error) {
+	if n, err = s.Conn.Read(b); err != nil {
+		s.once.Do(s.f)
+	}
+	return
+}
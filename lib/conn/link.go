@@ -27,7 +27,9 @@ type Link struct {
 type Option func(*Options)
 
 type Options struct {
-	Timeout time.Duration
+	Timeout       time.Duration
+	ProxyProtocol int        //version of the PROXY protocol header sent to the target, 0 means disabled
+	Tls           *TlsOption //the tls originated to the https target
 }
 
 var defaultTimeOut = time.Second * 5
@@ -61,3 +63,17 @@ func LinkTimeout(t time.Duration) Option {
 		opt.Timeout = t
 	}
 }
+
+//send the PROXY protocol header of the version to the target
+func LinkProxyProtocol(version int) Option {
+	return func(opt *Options) {
+		opt.ProxyProtocol = version
+	}
+}
+
+//the settings of the tls originated to the https target
+func LinkTls(tls *TlsOption) Option {
+	return func(opt *Options) {
+		opt.Tls = tls
+	}
+}
@@ -0,0 +1,82 @@
+package conn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/common"
+)
+
+//tls is originated to the targets with the prefix, eg: https://10.0.0.5:8443
+const HttpsTargetPrefix = "https://"
+
+//the tls originated to the https target, the files are read by the side which dials the target
+type TlsOption struct {
+	ServerName string //the host of the target by default
+	SkipVerify bool
+	Ca         string //the system roots by default
+	Cert       string
+	Key        string
+}
+
+//split the address of the target and whether tls should be originated to it, the port is 443 by default
+func SplitHttpsTarget(target string) (string, bool) {
+	if len(target) < len(HttpsTargetPrefix) || !strings.EqualFold(target[:len(HttpsTargetPrefix)], HttpsTargetPrefix) {
+		return target, false
+	}
+	addr := strings.TrimSuffix(target[len(HttpsTargetPrefix):], "/")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+	}
+	return addr, true
+}
+
+func (s *TlsOption) config(addr string) (*tls.Config, error) {
+	if s == nil {
+		s = new(TlsOption)
+	}
+	config := &tls.Config{ServerName: s.ServerName, InsecureSkipVerify: s.SkipVerify}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if s.Ca != "" {
+		b, err := common.ReadAllFromFile(s.Ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate found in " + s.Ca)
+		}
+	}
+	if s.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//originate tls to the https target over the connection, the connection should be closed by the caller if failed
+func NewTlsTargetConn(c net.Conn, addr string, opt *TlsOption, timeout time.Duration) (net.Conn, error) {
+	config, err := opt.config(addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeOut
+	}
+	tlsConn := tls.Client(c, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
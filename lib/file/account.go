@@ -0,0 +1,83 @@
+package file
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+//parse the accounts of the multi account, one username=password per line
+func ParseAccounts(s string) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		item := strings.SplitN(line, "=", 2)
+		if len(item) == 1 {
+			item = append(item, "")
+		}
+		m[strings.TrimSpace(item[0])] = item[1]
+	}
+	return m
+}
+
+//check the password of the account
+func (s *MultiAccount) Check(user, pass string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	p, ok := s.AccountMap[user]
+	return ok && p == pass
+}
+
+//replace the accounts, the stats of the accounts are kept
+func (s *MultiAccount) SetAccounts(m map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.AccountMap = m
+}
+
+//a connection of the account is established, the flow added to the returned flow
+//is added to the account and the task flow at once
+func (s *MultiAccount) GetConn(user string, task *Flow) *Flow {
+	s.Lock()
+	defer s.Unlock()
+	stat := s.getStat(user)
+	stat.NowConn++
+	stat.TotalConn++
+	return &Flow{onAdd: func(in, out int64) {
+		task.Add(in, out)
+		s.Lock()
+		defer s.Unlock()
+		stat := s.getStat(user)
+		stat.InletFlow += in
+		stat.ExportFlow += out
+	}}
+}
+
+//the connection of the account is closed
+func (s *MultiAccount) ReleaseConn(user string) {
+	s.Lock()
+	defer s.Unlock()
+	s.getStat(user).NowConn--
+}
+
+func (s *MultiAccount) getStat(user string) *AccountStat {
+	if s.AccountStat == nil {
+		s.AccountStat = make(map[string]*AccountStat)
+	}
+	stat, ok := s.AccountStat[user]
+	if !ok {
+		stat = new(AccountStat)
+		s.AccountStat[user] = stat
+	}
+	return stat
+}
+
+//the stats are updated by the connections, so marshal it with the lock
+func (s *MultiAccount) MarshalJSON() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	type multiAccount MultiAccount
+	return json.Marshal((*multiAccount)(s))
+}
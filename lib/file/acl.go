@@ -0,0 +1,336 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"ehang.io/nps/lib/geoip"
+)
+
+// AclRule is one line of the destination rules of socks5 and http proxy tunnels, eg:
+//   deny 10.0.0.0/8
+//   allow example.com 80,443,8000-9000
+//   deny all 22
+type AclRule struct {
+	Allow  bool
+	Net    *net.IPNet //ip or cidr
+	Domain string     //the domain and its subdomains
+	Ports  [][2]int   //port ranges, empty means all ports
+}
+
+//parse the destination rules, one rule per line, lines beginning with # are ignored
+func ParseAclRules(s string) (rules []*AclRule, err error) {
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule *AclRule
+		if rule, err = parseAclRule(line); err != nil {
+			return nil, errors.New(fmt.Sprintf("acl rule line %d: %s", i+1, err.Error()))
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func parseAclRule(line string) (*AclRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, errors.New("the rule must be allow|deny host [ports]")
+	}
+	rule := new(AclRule)
+	switch fields[0] {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return nil, errors.New("unknown action " + fields[0])
+	}
+	host := fields[1]
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		rule.Net = ipNet
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if host != "all" && host != "*" {
+		rule.Domain = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(host, "*"), "."))
+	}
+	if len(fields) == 3 {
+		for _, v := range strings.Split(fields[2], ",") {
+			arr := strings.SplitN(v, "-", 2)
+			start, err := strconv.Atoi(arr[0])
+			end := start
+			if err == nil && len(arr) == 2 {
+				end, err = strconv.Atoi(arr[1])
+			}
+			if err != nil || start < 1 || end > 65535 || start > end {
+				return nil, errors.New("illegal port " + v)
+			}
+			rule.Ports = append(rule.Ports, [2]int{start, end})
+		}
+	}
+	return rule, nil
+}
+
+//the resolver of the domain destinations checked by the ip rules
+var lookupIP = net.LookupIP
+
+//whether the destination matches the rule, host is an ip or a domain.
+//the domain is not resolved here, so it never matches the ip rules and the ip never matches the domain rules
+func (s *AclRule) Match(host string, port int) bool {
+	if !s.matchPort(port) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case s.Net != nil:
+		return ip != nil && s.Net.Contains(ip)
+	case s.Domain != "":
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return ip == nil && (host == s.Domain || strings.HasSuffix(host, "."+s.Domain))
+	}
+	return true
+}
+
+func (s *AclRule) matchPort(port int) bool {
+	if len(s.Ports) == 0 {
+		return true
+	}
+	for _, p := range s.Ports {
+		if port >= p[0] && port <= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+//whether the resolved ips of the domain match the ip rule, an allow rule needs all the ips in it
+//and a deny rule needs any of them, so the domain can not reach a denied ip by one of its addresses
+func (s *AclRule) matchIps(ips []net.IP, port int) bool {
+	if !s.matchPort(port) {
+		return false
+	}
+	for _, ip := range ips {
+		if s.Net.Contains(ip) != s.Allow {
+			return !s.Allow
+		}
+	}
+	return s.Allow
+}
+
+//get the parsed destination rules, the rules are parsed again when DestAcl is modified
+func (s *Tunnel) GetAclRules() ([]*AclRule, error) {
+	s.RLock()
+	rules, err, ok := s.destAcl, s.destAclErr, s.destAclStr == s.DestAcl
+	s.RUnlock()
+	if ok {
+		return rules, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.destAclStr != s.DestAcl {
+		s.destAcl, s.destAclErr = ParseAclRules(s.DestAcl)
+		s.destAclStr = s.DestAcl
+	}
+	return s.destAcl, s.destAclErr
+}
+
+//whether the destination address is allowed and the address to connect, the first rule matching it decides and it is allowed if none matches.
+//the domain is resolved when an ip rule is checked, then the checked ip is connected instead of the domain, so the resolver of the client
+//can not lead to another address. it is denied if the rules are invalid or the domain can not be resolved
+func (s *Tunnel) AllowDest(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	p, _ := strconv.Atoi(port)
+	rules, err := s.GetAclRules()
+	if err != nil {
+		return addr, false
+	}
+	var ips []net.IP
+	isDomain := net.ParseIP(host) == nil
+	for _, rule := range rules {
+		if rule.Net != nil && isDomain {
+			if ips == nil {
+				if ips, err = lookupIP(host); err != nil || len(ips) == 0 {
+					return addr, false
+				}
+				addr = net.JoinHostPort(ips[0].String(), port)
+			}
+			if rule.matchIps(ips, p) {
+				return addr, rule.Allow
+			}
+		} else if rule.Match(host, p) {
+			return addr, rule.Allow
+		}
+	}
+	return addr, true
+}
+
+// VisitorRule is an entry of the allow or deny list of the visitors, an ip, a cidr or a country code, eg:
+//   10.0.0.0/8, 1.2.3.4, CN
+type VisitorRule struct {
+	Net     *net.IPNet
+	Country string //the iso code of the country, looked up in the geoip database
+}
+
+//parse the visitor list, the entries are separated by commas, spaces or lines
+func ParseVisitorRules(s string) (rules []*VisitorRule, err error) {
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		rule := new(VisitorRule)
+		if strings.Contains(v, "/") {
+			if _, rule.Net, err = net.ParseCIDR(v); err != nil {
+				return nil, err
+			}
+		} else if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			rule.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if len(v) == 2 && strings.Trim(strings.ToUpper(v), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+			rule.Country = strings.ToUpper(v)
+		} else {
+			return nil, errors.New("illegal visitor rule " + v)
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+//the allow and deny list of the visitors, the visitor is rejected if it matches the deny list,
+//or the allow list is not empty and it does not match the allow list
+type VisitorFilter struct {
+	Allow []*VisitorRule
+	Deny  []*VisitorRule
+}
+
+//parse the visitor lists, the country rules are illegal if the geoip database is not loaded
+func NewVisitorFilter(allow, deny string) (*VisitorFilter, error) {
+	f, err := parseVisitorFilter(allow, deny)
+	if err != nil {
+		return nil, err
+	}
+	if geoipDb == nil {
+		for _, rule := range append(f.Allow, f.Deny...) {
+			if rule.Country != "" {
+				return nil, errors.New("the geoip database is not loaded for the country rule " + rule.Country)
+			}
+		}
+	}
+	return f, nil
+}
+
+func parseVisitorFilter(allow, deny string) (*VisitorFilter, error) {
+	var err error
+	f := new(VisitorFilter)
+	if f.Allow, err = ParseVisitorRules(allow); err != nil {
+		return nil, err
+	}
+	if f.Deny, err = ParseVisitorRules(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//whether the visitor ip is allowed, the country is looked up only if a country rule is checked
+func (s *VisitorFilter) AllowIp(ip net.IP) bool {
+	if s == nil {
+		return true
+	}
+	var country *string
+	match := func(rules []*VisitorRule) bool {
+		for _, rule := range rules {
+			if rule.Net != nil && rule.Net.Contains(ip) {
+				return true
+			}
+			if rule.Country != "" {
+				if country == nil {
+					c := lookupCountry(ip)
+					country = &c
+				}
+				if *country == rule.Country {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return !match(s.Deny) && (len(s.Allow) == 0 || match(s.Allow))
+}
+
+var (
+	geoipDb          *geoip.Reader
+	globalVisitor    *VisitorFilter
+	globalVisitorErr error //all the visitors are rejected if the global lists are invalid
+	visitorReject    int64 //the connections rejected by the visitor lists
+)
+
+//set the global visitor lists of all tunnels, the country rules need the geoip database.
+//the ip and cidr rules are still applied if the database can not be loaded, the country rules never match then
+func SetVisitorFilter(geoipPath, allow, deny string) (err error) {
+	if geoipPath != "" {
+		geoipDb, err = geoip.Open(geoipPath)
+	}
+	if globalVisitor, globalVisitorErr = parseVisitorFilter(allow, deny); globalVisitorErr != nil {
+		return globalVisitorErr
+	}
+	return
+}
+
+func lookupCountry(ip net.IP) string {
+	if geoipDb == nil {
+		return ""
+	}
+	return geoipDb.Country(ip)
+}
+
+//the connections rejected by the visitor lists of all tunnels
+func GetVisitorReject() int64 {
+	return atomic.LoadInt64(&visitorReject)
+}
+
+//get the parsed visitor lists of the tunnel, the lists are parsed again when they are modified
+func (s *Tunnel) GetVisitorFilter() (*VisitorFilter, error) {
+	s.RLock()
+	f, err, ok := s.visitorFilter, s.visitorErr, s.visitorStr == s.VisitorAllow+"\n"+s.VisitorDeny
+	s.RUnlock()
+	if ok {
+		return f, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if str := s.VisitorAllow + "\n" + s.VisitorDeny; s.visitorStr != str {
+		s.visitorFilter, s.visitorErr = NewVisitorFilter(s.VisitorAllow, s.VisitorDeny)
+		s.visitorStr = str
+	}
+	return s.visitorFilter, s.visitorErr
+}
+
+//whether the visitor ip is allowed by the global and the tunnel visitor lists, the rejected one is counted.
+//all the visitors are rejected if the lists are invalid
+func (s *Tunnel) AllowVisitor(ip string) bool {
+	addr := net.ParseIP(ip)
+	f, err := s.GetVisitorFilter()
+	if globalVisitorErr == nil && err == nil && (addr == nil || (globalVisitor.AllowIp(addr) && f.AllowIp(addr))) {
+		return true
+	}
+	atomic.AddInt64(&s.RejectConn, 1)
+	atomic.AddInt64(&visitorReject, 1)
+	return false
+}
@@ -0,0 +1,129 @@
+package file
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTunnelAllowDest(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "10.0.0.1.nip.io":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "ssh.test":
+			return []net.IP{net.ParseIP("192.168.1.5")}, nil
+		case "mixed.test":
+			return []net.IP{net.ParseIP("192.168.1.5"), net.ParseIP("8.8.8.8")}, nil
+		case "unknown.test":
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP("93.184.216.34")}, nil
+	}
+	defer func() { lookupIP = net.LookupIP }()
+	tl := &Tunnel{DestAcl: `# comment
+deny 10.0.0.0/8
+allow 192.168.1.5 22
+deny all 22
+allow *.example.com 80,443,8000-9000
+deny example.com
+deny fd00::/8`}
+	cases := []struct {
+		addr  string
+		allow bool
+		dest  string //empty means the address is not changed
+	}{
+		{"10.1.2.3:80", false, ""},
+		{"192.168.1.5:22", true, ""},
+		{"192.168.1.6:22", false, ""},
+		{"a.example.com:8080", true, "93.184.216.34:8080"},
+		{"EXAMPLE.com:443", true, "93.184.216.34:443"},
+		{"example.com:25", false, ""},
+		{"badexample.com:25", true, "93.184.216.34:25"},
+		{"[fd00::1]:80", false, ""},
+		{"[2001:db8::1]:80", true, ""},
+		{"172.16.0.1:3306", true, ""},
+		{"10.0.0.1.nip.io:80", false, ""},
+		{"ssh.test:22", true, "192.168.1.5:22"},
+		{"mixed.test:22", false, ""},
+		{"mixed.test:80", true, "192.168.1.5:80"},
+		{"unknown.test:80", false, ""},
+	}
+	for _, c := range cases {
+		dest, allow := tl.AllowDest(c.addr)
+		if allow != c.allow {
+			t.Fatalf("addr %s, want %v", c.addr, c.allow)
+		}
+		if c.dest == "" {
+			c.dest = c.addr
+		}
+		if allow && dest != c.dest {
+			t.Fatalf("addr %s, connect to %s, want %s", c.addr, dest, c.dest)
+		}
+	}
+	//the domain is not resolved if no ip rule is checked
+	if dest, _ := (&Tunnel{DestAcl: "allow example.com"}).AllowDest("example.com:80"); dest != "example.com:80" {
+		t.Fatalf("connect to %s, want the domain", dest)
+	}
+	//the invalid rules deny all
+	if _, allow := (&Tunnel{DestAcl: "allow all\npermit all"}).AllowDest("172.16.0.1:80"); allow {
+		t.Fatal("the invalid rules should deny all")
+	}
+	for _, s := range []string{"allow", "permit all", "deny 10.0.0.0/33", "allow all 0", "deny all 90-80", "deny all 22 x"} {
+		if _, err := ParseAclRules(s); err == nil {
+			t.Fatalf("rule %s should be illegal", s)
+		}
+	}
+}
+
+func TestVisitorFilter(t *testing.T) {
+	f, err := NewVisitorFilter("192.168.0.0/16, 10.1.2.3\n2001:db8::/32", "192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip    string
+		allow bool
+	}{
+		{"192.168.2.1", true},
+		{"192.168.1.1", false},
+		{"10.1.2.3", true},
+		{"10.1.2.4", false},
+		{"2001:db8::1", true},
+		{"fd00::1", false},
+	}
+	for _, c := range cases {
+		if f.AllowIp(net.ParseIP(c.ip)) != c.allow {
+			t.Fatalf("ip %s, want %v", c.ip, c.allow)
+		}
+	}
+	for _, s := range []string{"abc", "10.0.0.0/33", "C1"} {
+		if _, err := ParseVisitorRules(s); err == nil {
+			t.Fatalf("rule %s should be illegal", s)
+		}
+	}
+	//the country rules need the geoip database
+	if _, err := NewVisitorFilter("CN", ""); err == nil {
+		t.Fatal("the country rule should be illegal without the geoip database")
+	}
+	//the invalid lists reject all the visitors
+	tl := &Tunnel{VisitorAllow: "192.168.0.0/16", VisitorDeny: "abc"}
+	if tl.AllowVisitor("192.168.1.1") {
+		t.Fatal("the invalid lists should reject all")
+	}
+	tl.VisitorDeny = ""
+	if !tl.AllowVisitor("192.168.1.1") || tl.AllowVisitor("10.0.0.1") {
+		t.Fatal("the visitor lists are not applied after modified")
+	}
+	//the global ip lists are applied even if the geoip database can not be loaded
+	defer SetVisitorFilter("", "", "")
+	if err := SetVisitorFilter("not_exist.mmdb", "", "192.168.1.0/24"); err == nil {
+		t.Fatal("the geoip database should not be loaded")
+	}
+	if tl.AllowVisitor("192.168.1.1") || !tl.AllowVisitor("192.168.2.1") {
+		t.Fatal("the global lists are not applied")
+	}
+	if SetVisitorFilter("", "abc", "") == nil || tl.AllowVisitor("192.168.2.1") {
+		t.Fatal("the invalid global lists should reject all")
+	}
+}
@@ -0,0 +1,154 @@
+package file
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+//load balancing strategies of the target
+const (
+	LbRoundRobin = "rr"
+	LbLeastConn  = "leastconn"
+	LbIpHash     = "iphash"
+	LbCookie     = "cookie"
+)
+
+//the cookie name used by cookie sticky session
+const StickyCookieName = "NPS_STICKY"
+
+//parse the target string, one target per line, options can follow the address, eg:
+//  127.0.0.1:8080 weight=3
+func parseTargetStr(str string) (addrs []string, weights map[string]int) {
+	weights = make(map[string]int)
+	for _, line := range strings.Split(str, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		weight := 1
+		for _, opt := range fields[1:] {
+			if strings.HasPrefix(opt, "weight=") {
+				if w, err := strconv.Atoi(strings.TrimPrefix(opt, "weight=")); err == nil && w > 0 {
+					weight = w
+				}
+			}
+		}
+		addrs = append(addrs, fields[0])
+		weights[fields[0]] = weight
+	}
+	return
+}
+
+//the addresses of the target string, without options
+func (s *Target) TargetAddrs() []string {
+	addrs, _ := parseTargetStr(s.TargetStr)
+	return addrs
+}
+
+//get a target by the load balancing strategy, ip is the visitor ip and sticky is the value of the sticky cookie.
+//the target should be released by ReleaseTarget after the connection closed
+func (s *Target) GetTarget(ip, sticky string) (addr string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.TargetArr == nil {
+		s.TargetArr = s.TargetAddrs()
+	}
+	if s.weights == nil {
+		_, s.weights = parseTargetStr(s.TargetStr)
+	}
+	arr := s.availableTargets()
+	switch len(arr) {
+	case 0:
+		return "", errors.New("all inward-bending targets are offline")
+	case 1:
+		addr = arr[0]
+	default:
+		switch s.Strategy {
+		case LbLeastConn:
+			addr = s.leastConn(arr)
+		case LbIpHash:
+			h := fnv.New32a()
+			h.Write([]byte(ip))
+			addr = arr[h.Sum32()%uint32(len(arr))]
+		case LbCookie:
+			for _, v := range arr {
+				if sticky != "" && StickyValue(v) == sticky {
+					addr = v
+					break
+				}
+			}
+			if addr == "" {
+				addr = s.weightedRoundRobin(arr)
+			}
+		default:
+			addr = s.weightedRoundRobin(arr)
+		}
+	}
+	if s.conns == nil {
+		s.conns = make(map[string]int)
+	}
+	s.conns[addr]++
+	return
+}
+
+//release the target got by GetTarget
+func (s *Target) ReleaseTarget(addr string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.conns[addr] > 0 {
+		s.conns[addr]--
+	}
+}
+
+//get the current connection num of the target
+func (s *Target) GetTargetConn(addr string) int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.conns[addr]
+}
+
+func (s *Target) weight(addr string) int {
+	if w, ok := s.weights[addr]; ok {
+		return w
+	}
+	return 1
+}
+
+//smooth weighted round robin, the same as plain round robin when all weights are equal
+func (s *Target) weightedRoundRobin(arr []string) string {
+	if s.curWeights == nil {
+		s.curWeights = make(map[string]int)
+	}
+	var best string
+	var total int
+	for _, v := range arr {
+		w := s.weight(v)
+		s.curWeights[v] += w
+		total += w
+		if best == "" || s.curWeights[v] > s.curWeights[best] {
+			best = v
+		}
+	}
+	s.curWeights[best] -= total
+	return best
+}
+
+//the target with least connections relative to its weight
+func (s *Target) leastConn(arr []string) string {
+	best := arr[0]
+	for _, v := range arr[1:] {
+		if s.conns[v]*s.weight(best) < s.conns[best]*s.weight(v) {
+			best = v
+		}
+	}
+	return best
+}
+
+//the value of sticky cookie for the target, the real address is not exposed to the visitor
+func StickyValue(addr string) string {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
@@ -4,14 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/astaxie/beego/logs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"ehang.io/nps/lib/common"
-	"ehang.io/nps/lib/rate"
 )
 
 func NewJsonDb(runPath string) *JsonDb {
@@ -20,6 +21,7 @@ func NewJsonDb(runPath string) *JsonDb {
 		TaskFilePath:   filepath.Join(runPath, "conf", "tasks.json"),
 		HostFilePath:   filepath.Join(runPath, "conf", "hosts.json"),
 		ClientFilePath: filepath.Join(runPath, "conf", "clients.json"),
+		GlobalFilePath: filepath.Join(runPath, "conf", "global.json"),
 	}
 }
 
@@ -35,6 +37,7 @@ type JsonDb struct {
 	TaskFilePath     string //task file path
 	HostFilePath     string //host file path
 	ClientFilePath   string //client file path
+	GlobalFilePath   string //global flow file path
 }
 
 func (s *JsonDb) LoadTaskFromJsonFile() {
@@ -47,6 +50,17 @@ func (s *JsonDb) LoadTaskFromJsonFile() {
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
 			return
 		}
+		if post.Target != nil {
+			post.Target.EjectedArr = nil
+		}
+		//no connection of the accounts is alive after restarting
+		if post.MultiAccount != nil {
+			for _, stat := range post.MultiAccount.AccountStat {
+				stat.NowConn = 0
+			}
+		}
+		post.UdpStat.NowSess = 0
+		post.NowConn = 0
 		s.Tasks.Store(post.Id, post)
 		if post.Id > int(s.TaskIncreaseId) {
 			s.TaskIncreaseId = int32(post.Id)
@@ -60,12 +74,7 @@ func (s *JsonDb) LoadClientFromJsonFile() {
 		if json.Unmarshal([]byte(v), &post) != nil {
 			return
 		}
-		if post.RateLimit > 0 {
-			post.Rate = rate.NewRate(int64(post.RateLimit * 1024))
-		} else {
-			post.Rate = rate.NewRate(int64(2 << 23))
-		}
-		post.Rate.Start()
+		post.SetRate()
 		post.NowConn = 0
 		s.Clients.Store(post.Id, post)
 		if post.Id > int(s.ClientIncreaseId) {
@@ -84,6 +93,10 @@ func (s *JsonDb) LoadHostFromJsonFile() {
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
 			return
 		}
+		if post.Target != nil {
+			post.Target.EjectedArr = nil
+		}
+		post.NowConn = 0
 		s.Hosts.Store(post.Id, post)
 		if post.Id > int(s.HostIncreaseId) {
 			s.HostIncreaseId = int32(post.Id)
@@ -91,6 +104,20 @@ func (s *JsonDb) LoadHostFromJsonFile() {
 	})
 }
 
+//load the flow of the month counted by the global limits, the file does not exist before the first storing
+func (s *JsonDb) LoadGlobalFromJsonFile() {
+	b, err := ioutil.ReadFile(s.GlobalFilePath)
+	if err != nil {
+		return
+	}
+	g := GetGlobal()
+	g.Lock()
+	defer g.Unlock()
+	if err := json.Unmarshal(b, g); err != nil {
+		logs.Error("load the global flow error", err)
+	}
+}
+
 func (s *JsonDb) GetClient(id int) (c *Client, err error) {
 	if v, ok := s.Clients.Load(id); ok {
 		c = v.(*Client)
@@ -124,6 +151,27 @@ func (s *JsonDb) StoreClientsToJsonFile() {
 	clientLock.Unlock()
 }
 
+var globalLock sync.Mutex
+
+func (s *JsonDb) StoreGlobalToJsonFile() {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	g := GetGlobal()
+	g.Lock()
+	g.update(time.Now())
+	b, err := json.Marshal(g)
+	g.Unlock()
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(s.GlobalFilePath+".tmp", b, 0644); err == nil {
+		err = os.Rename(s.GlobalFilePath+".tmp", s.GlobalFilePath)
+	}
+	if err != nil {
+		logs.Error(err, "store the global flow err")
+	}
+}
+
 func (s *JsonDb) GetClientId() int32 {
 	return atomic.AddInt32(&s.ClientIncreaseId, 1)
 }
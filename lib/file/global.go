@@ -0,0 +1,111 @@
+package file
+
+import (
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/rate"
+)
+
+//the actions after the flow of the month exceeds the global flow limit
+const (
+	GlobalExceedReject   = "reject"   //reject the new connections
+	GlobalExceedThrottle = "throttle" //limit the global rate to the throttle rate
+)
+
+//the server-wide limits shared by all clients, the rate of it is the parent of the rates of all clients.
+//the flow of the month is stored in global.json
+type Global struct {
+	Month      string //the month of the flow, eg 2006-01
+	InletFlow  int64
+	ExportFlow int64
+
+	rateLimit    int   //kb/s, 0 means unlimited
+	flowLimit    int64 //the flow limit of a month /M, 0 means unlimited
+	resetDay     int   //the day of the month the flow is reset
+	exceedAction string
+	throttleRate int //kb/s after the flow limit is exceeded
+	exceeded     bool
+	rate         *rate.Rate
+	lastIn       int64 //the flow of the rate which has been counted
+	lastOut      int64
+	sync.Mutex   `json:"-"`
+}
+
+var global = &Global{rate: rate.NewRate(0), resetDay: 1}
+
+func GetGlobal() *Global {
+	return global
+}
+
+//set the global limits, resetDay is from 1 to 28 and the flow is throttled only if the throttle rate is set
+func SetGlobalLimit(rateLimit int, flowLimit int64, resetDay int, exceedAction string, throttleRate int) {
+	global.Lock()
+	defer global.Unlock()
+	if resetDay < 1 || resetDay > 28 {
+		resetDay = 1
+	}
+	if exceedAction != GlobalExceedThrottle || throttleRate <= 0 {
+		exceedAction = GlobalExceedReject
+	}
+	global.rateLimit, global.flowLimit, global.resetDay = rateLimit, flowLimit, resetDay
+	global.exceedAction, global.throttleRate = exceedAction, throttleRate
+	global.update(time.Now())
+	global.setRate()
+}
+
+//the global rate, it is never changed so the clients can keep it as the parent
+func (s *Global) GetRate() *rate.Rate {
+	return s.rate
+}
+
+//whether the new connections should be rejected because the flow of the month is exceeded
+func (s *Global) Exceeded() bool {
+	s.Lock()
+	defer s.Unlock()
+	s.update(time.Now())
+	return s.exceeded && s.exceedAction == GlobalExceedReject
+}
+
+//the flow of the month, the flow limit in bytes, the current rate and the rate limit in bytes per second
+func (s *Global) Stat() (flow, flowLimit, nowRate, rateLimit int64, exceeded bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.update(time.Now())
+	rateLimit = int64(s.currentRateLimit()) << 10
+	return s.InletFlow + s.ExportFlow, s.flowLimit << 20, s.rate.NowRate(), rateLimit, s.exceeded
+}
+
+//count the flow passed the rate since last time, the flow is reset in a new month
+func (s *Global) update(now time.Time) {
+	in, out := s.rate.Flow()
+	s.InletFlow += in - s.lastIn
+	s.ExportFlow += out - s.lastOut
+	s.lastIn, s.lastOut = in, out
+	if month := s.month(now); month != s.Month {
+		s.Month, s.InletFlow, s.ExportFlow = month, 0, 0
+	}
+	if exceeded := s.flowLimit > 0 && s.InletFlow+s.ExportFlow >= s.flowLimit<<20; exceeded != s.exceeded {
+		s.exceeded = exceeded
+		s.setRate()
+	}
+}
+
+//the month begins on the reset day, eg 2006-01 is from Jan 15 to Feb 14 if the reset day is 15
+func (s *Global) month(now time.Time) string {
+	if now.Day() < s.resetDay {
+		now = now.AddDate(0, -1, 0)
+	}
+	return now.Format("2006-01")
+}
+
+func (s *Global) currentRateLimit() int {
+	if s.exceeded && s.exceedAction == GlobalExceedThrottle && (s.rateLimit <= 0 || s.throttleRate < s.rateLimit) {
+		return s.throttleRate
+	}
+	return s.rateLimit
+}
+
+func (s *Global) setRate() {
+	s.rate.SetLimit(int64(s.currentRateLimit())<<10, 0, 0, 0)
+}
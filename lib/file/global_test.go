@@ -0,0 +1,62 @@
+package file
+
+import (
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/rate"
+)
+
+func TestGlobalUpdate(t *testing.T) {
+	g := &Global{rate: rate.NewRate(0), resetDay: 15, flowLimit: 1, exceedAction: GlobalExceedReject}
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(2026, month, day, 12, 0, 0, 0, time.Local)
+	}
+	g.update(date(1, 10))
+	if g.Month != "2025-12" {
+		t.Fatalf("month %s, the days before the reset day belong to the last month", g.Month)
+	}
+	g.update(date(1, 20))
+	if g.Month != "2026-01" || g.exceeded {
+		t.Fatalf("month %s, exceeded %v", g.Month, g.exceeded)
+	}
+	g.rate.GetIn(600 << 10)
+	g.rate.GetOut(600 << 10)
+	g.update(date(2, 14))
+	if g.Month != "2026-01" || g.InletFlow != 600<<10 || g.ExportFlow != 600<<10 || !g.exceeded {
+		t.Fatalf("month %s, flow %d %d, exceeded %v", g.Month, g.InletFlow, g.ExportFlow, g.exceeded)
+	}
+	//the flow counted before is not counted again
+	g.update(date(2, 14))
+	if g.InletFlow != 600<<10 {
+		t.Fatalf("flow %d, counted twice", g.InletFlow)
+	}
+	g.update(date(2, 15))
+	if g.Month != "2026-02" || g.InletFlow != 0 || g.ExportFlow != 0 || g.exceeded {
+		t.Fatalf("month %s, flow %d %d, exceeded %v, the flow should be reset", g.Month, g.InletFlow, g.ExportFlow, g.exceeded)
+	}
+	g.update(date(12, 31))
+	g.update(time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local))
+	if g.Month != "2026-12" {
+		t.Fatalf("month %s, want 2026-12", g.Month)
+	}
+}
+
+func TestGlobalThrottle(t *testing.T) {
+	g := &Global{rate: rate.NewRate(0), resetDay: 1, flowLimit: 1, rateLimit: 1000, exceedAction: GlobalExceedThrottle, throttleRate: 100}
+	now := time.Now()
+	g.update(now)
+	if g.currentRateLimit() != 1000 {
+		t.Fatalf("rate limit %d before exceeded", g.currentRateLimit())
+	}
+	g.rate.GetIn(1 << 20)
+	g.update(now)
+	if !g.exceeded || g.currentRateLimit() != 100 {
+		t.Fatalf("rate limit %d after exceeded, want the throttle rate", g.currentRateLimit())
+	}
+	//the throttle rate does not raise the rate limit
+	g.throttleRate = 2000
+	if g.currentRateLimit() != 1000 {
+		t.Fatalf("rate limit %d, want 1000", g.currentRateLimit())
+	}
+}
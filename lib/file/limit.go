@@ -0,0 +1,105 @@
+package file
+
+import (
+	"sync/atomic"
+
+	"ehang.io/nps/lib/rate"
+)
+
+//whether the request of the visitor ip is allowed by the request rate limit of the host
+func (s *Host) AllowRequest(ip string) bool {
+	if s.IpRateLimit <= 0 {
+		return true
+	}
+	return s.getIpLimiter().Allow(ip, s.IpRateLimit, s.IpRateBurst)
+}
+
+func (s *Host) getIpLimiter() *rate.IpLimiter {
+	s.Lock()
+	defer s.Unlock()
+	if s.ipLimiter == nil {
+		s.ipLimiter = rate.NewIpLimiter()
+	}
+	return s.ipLimiter
+}
+
+//get a connection of the visitor ip, return false if the connections of the ip reach the limit of the tunnel
+func (s *Tunnel) GetIpConn(ip string) bool {
+	if s.IpConnLimit <= 0 {
+		return true
+	}
+	s.Lock()
+	if s.ipLimiter == nil {
+		s.ipLimiter = rate.NewIpLimiter()
+	}
+	l := s.ipLimiter
+	s.Unlock()
+	return l.GetConn(ip, s.IpConnLimit)
+}
+
+//release the connection of the visitor ip got by GetIpConn
+func (s *Tunnel) ReleaseIpConn(ip string) {
+	s.RLock()
+	l := s.ipLimiter
+	s.RUnlock()
+	if l != nil {
+		l.ReleaseConn(ip)
+	}
+}
+
+//get a connection, return false if the connections reach the limit
+func (s *Limit) GetConn() bool {
+	if n := atomic.AddInt32(&s.NowConn, 1); s.MaxConn > 0 && int(n) > s.MaxConn {
+		atomic.AddInt32(&s.NowConn, -1)
+		return false
+	}
+	return true
+}
+
+//release the connection got by GetConn
+func (s *Limit) ReleaseConn() {
+	atomic.AddInt32(&s.NowConn, -1)
+}
+
+//create the rate of the limits in kb, 0 means unlimited
+func newRate(total, in, out, burst int) *rate.Rate {
+	return rate.NewLimitRate(int64(total)<<10, int64(in)<<10, int64(out)<<10, int64(burst)<<10)
+}
+
+//get the rate limiting the connections of the tunnel or host within the parent, eg the rate of the client.
+//the parent is returned if unlimited, the rate is created again when the limits are modified
+func (s *Limit) GetRate(parent *rate.Rate) *rate.Rate {
+	s.Lock()
+	defer s.Unlock()
+	limit := [4]int{s.RateLimit, s.InRateLimit, s.OutRateLimit, s.RateBurst}
+	if limit[0] <= 0 && limit[1] <= 0 && limit[2] <= 0 {
+		s.rate = nil
+		return parent
+	}
+	if s.rate == nil || s.rateLimit != limit {
+		s.rate = newRate(limit[0], limit[1], limit[2], limit[3])
+		s.rateLimit = limit
+	}
+	s.rate.SetParent(parent)
+	return s.rate
+}
+
+//create the rate of the client by the rate limits, it is limited by the global rate too
+func (s *Client) SetRate() {
+	s.Rate = newRate(s.RateLimit, s.InRateLimit, s.OutRateLimit, s.RateBurst)
+	s.Rate.SetParent(GetGlobal().GetRate())
+}
+
+//a new flow keeping the flow limit of the old one
+func newFlow(old *Flow) *Flow {
+	flow := new(Flow)
+	if old != nil {
+		flow.FlowLimit = old.FlowLimit
+	}
+	return flow
+}
+
+//whether the flow exceeds the flow limit in MB
+func (s *Flow) Exceeded() bool {
+	return s.FlowLimit > 0 && (s.FlowLimit<<20) < (s.ExportFlow+s.InletFlow)
+}
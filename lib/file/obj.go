@@ -1,13 +1,11 @@
 package file
 
 import (
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"ehang.io/nps/lib/rate"
-	"github.com/pkg/errors"
 )
 
 type Flow struct {
@@ -15,13 +13,18 @@ type Flow struct {
 	InletFlow  int64
 	FlowLimit  int64
 	sync.RWMutex
+
+	onAdd func(in, out int64) //called after the flow is added
 }
 
 func (s *Flow) Add(in, out int64) {
 	s.Lock()
-	defer s.Unlock()
 	s.InletFlow += int64(in)
 	s.ExportFlow += int64(out)
+	s.Unlock()
+	if s.onAdd != nil {
+		s.onAdd(in, out)
+	}
 }
 
 type Config struct {
@@ -40,6 +43,9 @@ type Client struct {
 	Status          bool       //is allow connect
 	IsConnect       bool       //is the client connect
 	RateLimit       int        //rate /kb
+	InRateLimit     int        //rate of the inlet flow /kb
+	OutRateLimit    int        //rate of the export flow /kb
+	RateBurst       int        //burst of the rate /kb, one second of the rate by default
 	Flow            *Flow      //flow setting
 	Rate            *rate.Rate //rate limit
 	NoStore         bool       //no store to file
@@ -142,8 +148,48 @@ type Tunnel struct {
 	StripPre     string
 	Target       *Target
 	MultiAccount *MultiAccount
+	IpConnLimit  int    //max concurrent connections of each visitor ip, 0 means unlimited
+	DestAcl      string //destination rules of socks5 and http proxy, one rule per line
+	UdpTimeout   int    //idle timeout seconds of the udp sessions, 0 means the default
+	UdpMaxSess   int    //max concurrent udp sessions, 0 means unlimited
+	UdpStat      UdpStat
+	VisitorAllow string //the ips, cidrs or country codes of the visitors allowed, empty means all
+	VisitorDeny  string //the ips, cidrs or country codes of the visitors denied
+	RejectConn   int64  //the connections rejected by the visitor lists
+	Limit
 	Health
 	sync.RWMutex
+
+	ipLimiter  *rate.IpLimiter
+	destAcl    []*AclRule //parsed DestAcl
+	destAclStr string
+	destAclErr error
+
+	visitorFilter *VisitorFilter //parsed VisitorAllow and VisitorDeny
+	visitorStr    string
+	visitorErr    error
+}
+
+//the limits of the tunnel or host besides the limits of the client, the flow limit is in Flow
+type Limit struct {
+	RateLimit    int   //rate limit kb/s, 0 means unlimited
+	InRateLimit  int   //rate limit of the inlet flow kb/s
+	OutRateLimit int   //rate limit of the export flow kb/s
+	RateBurst    int   //burst of the rate kb, one second of the rate by default
+	MaxConn      int   //max concurrent connections, 0 means unlimited
+	NowConn      int32 //current connections
+	sync.Mutex
+
+	rate      *rate.Rate
+	rateLimit [4]int //the rate limits of the rate
+}
+
+//the sessions of the udp tunnel, a session is the packets from one visitor address
+type UdpStat struct {
+	NowSess    int
+	TotalSess  int64
+	RejectSess int64 //sessions rejected as the max sessions are reached
+	sync.Mutex
 }
 
 type Health struct {
@@ -167,44 +213,69 @@ type Host struct {
 	Location     string //url router
 	Remark       string //remark
 	Scheme       string //http https all
+	ForceHttps   bool   //redirect the http requests to https
+	HstsMaxAge   int    //max-age of the HSTS header of the https responses, 0 means disabled
 	CertFilePath string
 	KeyFilePath  string
+	ClientCa     string //ca bundle file to verify the client certificates, empty means disabled
+	ClientAuth   string //verification mode of the client certificates, require or optional
+	CertHeader   string //header to forward the subject of the verified client certificate
 	NoStore      bool
+	NoCache      bool //disable the http cache
 	IsClose      bool
 	Flow         *Flow
 	Client       *Client
 	Target       *Target //目标
+	RouteRules   string  //route rules, one rule per line
+	RespHeader   string  //response header change
+	CorsOrigin   string  //allowed cors origins, * or separated by comma
+	Compression  string  //response compression, gzip and br in order of preference, empty means disabled
+	CompressType string  //compressible content types separated by comma, empty means the default
+	ErrorPage    string  //custom error page template, empty means the global one
+	AccessLog    bool    //write a dedicated access log of the host
+	IpRateLimit  int     //max requests per second of each visitor ip, 0 means unlimited
+	IpRateBurst  int     //burst requests of each visitor ip, default IpRateLimit
+	Inspect      bool    //capture the recent requests and responses for the web
 	Health       `json:"-"`
+	Limit
 	sync.RWMutex
+
+	routeRules    []*RouteRule //parsed RouteRules
+	routeRulesStr string
+	ipLimiter     *rate.IpLimiter
 }
 
 type Target struct {
-	nowIndex   int
-	TargetStr  string
-	TargetArr  []string
-	LocalProxy bool
+	TargetStr     string
+	TargetArr     []string
+	LocalProxy    bool
+	Strategy      string   //load balancing strategy
+	EjectedArr    []string //targets ejected by outlier detection
+	ProxyProtocol int      //version of the PROXY protocol header sent to the target, 0 means disabled
+	TlsServerName string   //the server name sent to the https targets, the host of the target by default
+	TlsSkipVerify bool     //do not verify the certificates of the https targets
+	TlsCa         string   //the ca file to verify the https targets, read by the client
+	TlsCert       string   //the client certificate file sent to the https targets, read by the client
+	TlsKey        string
 	sync.RWMutex
+
+	weights    map[string]int
+	curWeights map[string]int
+	conns      map[string]int
+	failures   map[string]int
+	backoff    map[string]uint
+	ejectUntil map[string]time.Time
 }
 
 type MultiAccount struct {
-	AccountMap map[string]string // multi account and pwd
+	AccountMap  map[string]string       // multi account and pwd
+	AccountStat map[string]*AccountStat // flow and connections of each account
+	sync.RWMutex
 }
 
-func (s *Target) GetRandomTarget() (string, error) {
-	if s.TargetArr == nil {
-		s.TargetArr = strings.Split(s.TargetStr, "\n")
-	}
-	if len(s.TargetArr) == 1 {
-		return s.TargetArr[0], nil
-	}
-	if len(s.TargetArr) == 0 {
-		return "", errors.New("all inward-bending targets are offline")
-	}
-	s.Lock()
-	defer s.Unlock()
-	if s.nowIndex >= len(s.TargetArr)-1 {
-		s.nowIndex = -1
-	}
-	s.nowIndex++
-	return s.TargetArr[s.nowIndex], nil
+type AccountStat struct {
+	InletFlow  int64
+	ExportFlow int64
+	NowConn    int32
+	TotalConn  int64
 }
@@ -0,0 +1,82 @@
+package file
+
+import (
+	"time"
+
+	"ehang.io/nps/lib/common"
+)
+
+//passive outlier detection, a target is ejected after continuous connect failures
+var (
+	outlierMaxFail   = 5
+	outlierEjectTime = 30 * time.Second
+)
+
+//the eject time is doubled at most this times when the target fails again after retry
+const outlierMaxBackoff = 5
+
+//set the passive outlier detection, maxFail is the continuous failures before ejected, 0 means disabled
+func SetOutlierDetection(maxFail int, ejectTime time.Duration) {
+	outlierMaxFail = maxFail
+	if ejectTime > 0 {
+		outlierEjectTime = ejectTime
+	}
+}
+
+//report the result of connecting to the target, return true if the target is ejected by this failure
+func (s *Target) ReportTarget(addr string, ok bool) bool {
+	if outlierMaxFail <= 0 || addr == "" {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	if ok {
+		delete(s.failures, addr)
+		delete(s.backoff, addr)
+		return false
+	}
+	if t, ok := s.ejectUntil[addr]; ok && time.Now().Before(t) {
+		//failures of the connections created before ejected
+		return false
+	}
+	if s.failures == nil {
+		s.failures = make(map[string]int)
+		s.backoff = make(map[string]uint)
+		s.ejectUntil = make(map[string]time.Time)
+	}
+	if s.failures[addr]++; s.failures[addr] < outlierMaxFail {
+		return false
+	}
+	s.ejectUntil[addr] = time.Now().Add(outlierEjectTime << s.backoff[addr])
+	if s.backoff[addr] < outlierMaxBackoff {
+		s.backoff[addr]++
+	}
+	if !common.IsArrContains(s.EjectedArr, addr) {
+		s.EjectedArr = append(s.EjectedArr, addr)
+	}
+	return true
+}
+
+//the targets not ejected, the ejected target is retried after the eject time.
+//if all targets are ejected, return all of them rather than none
+func (s *Target) availableTargets() []string {
+	if len(s.ejectUntil) == 0 {
+		return s.TargetArr
+	}
+	now := time.Now()
+	arr := make([]string, 0, len(s.TargetArr))
+	for _, v := range s.TargetArr {
+		if t, ok := s.ejectUntil[v]; ok {
+			if now.Before(t) {
+				continue
+			}
+			delete(s.ejectUntil, v)
+			s.EjectedArr = common.RemoveArrVal(s.EjectedArr, v)
+		}
+		arr = append(arr, v)
+	}
+	if len(arr) == 0 {
+		return s.TargetArr
+	}
+	return arr
+}
@@ -0,0 +1,201 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	RouteExact  = "exact"
+	RoutePrefix = "prefix"
+	RouteRegex  = "regex"
+)
+
+// RouteRule is one line of the host route rules, eg:
+//   prefix=/old redirect=https://a.proxy.com/new code=301
+//   regex=^/api/(.*)$ rewrite=/v2/$1
+//   exact=/ping header=X-Env:^beta$ respond=pong
+type RouteRule struct {
+	MatchType string
+	Path      string
+	Headers   map[string]*regexp.Regexp
+	Rewrite   string
+	Redirect  string
+	Respond   string
+	Code      int
+	pathReg   *regexp.Regexp
+}
+
+//parse the route rules, one rule per line, lines beginning with # are ignored
+func ParseRouteRules(s string) (rules []*RouteRule, err error) {
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule *RouteRule
+		if rule, err = parseRouteRule(line); err != nil {
+			return nil, errors.New(fmt.Sprintf("route rule line %d: %s", i+1, err.Error()))
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func parseRouteRule(line string) (*RouteRule, error) {
+	rule := &RouteRule{Headers: make(map[string]*regexp.Regexp)}
+	for line != "" {
+		var item string
+		if strings.HasPrefix(line, "respond=") {
+			//the fixed response body takes the rest of the line
+			item, line = line, ""
+		} else if i := strings.IndexAny(line, " \t"); i > -1 {
+			item, line = line[:i], strings.TrimSpace(line[i:])
+		} else {
+			item, line = line, ""
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("illegal item " + item)
+		}
+		switch kv[0] {
+		case RouteExact, RoutePrefix, RouteRegex:
+			if rule.MatchType != "" {
+				return nil, errors.New("only one of exact, prefix and regex is allowed")
+			}
+			rule.MatchType = kv[0]
+			rule.Path = kv[1]
+		case "header":
+			hd := strings.SplitN(kv[1], ":", 2)
+			if len(hd) != 2 {
+				return nil, errors.New("header match must be name:regex")
+			}
+			reg, err := regexp.Compile(hd[1])
+			if err != nil {
+				return nil, err
+			}
+			rule.Headers[http.CanonicalHeaderKey(hd[0])] = reg
+		case "rewrite":
+			rule.Rewrite = kv[1]
+		case "redirect":
+			rule.Redirect = kv[1]
+		case "respond":
+			rule.Respond = kv[1]
+		case "code":
+			code, err := strconv.Atoi(kv[1])
+			if err != nil || code < 100 || code > 599 {
+				return nil, errors.New("illegal status code " + kv[1])
+			}
+			rule.Code = code
+		default:
+			return nil, errors.New("unknown item " + kv[0])
+		}
+	}
+	if rule.MatchType == "" {
+		if len(rule.Headers) == 0 {
+			return nil, errors.New("exact, prefix, regex or header is required")
+		}
+		rule.MatchType = RoutePrefix
+		rule.Path = "/"
+	}
+	var actions int
+	for _, v := range []string{rule.Rewrite, rule.Redirect, rule.Respond} {
+		if v != "" {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return nil, errors.New("exactly one of rewrite, redirect and respond is required")
+	}
+	if rule.MatchType == RouteRegex {
+		var err error
+		if rule.pathReg, err = regexp.Compile(rule.Path); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Code == 0 {
+		if rule.Redirect != "" {
+			rule.Code = http.StatusFound
+		} else {
+			rule.Code = http.StatusOK
+		}
+	}
+	if rule.Redirect != "" && (rule.Code < 300 || rule.Code > 399) {
+		return nil, errors.New("redirect code must be 3xx")
+	}
+	return rule, nil
+}
+
+//whether the request matches the rule, return the expanded path used by rewrite and redirect
+func (s *RouteRule) Match(r *http.Request) (string, bool) {
+	for k, reg := range s.Headers {
+		if !reg.MatchString(r.Header.Get(k)) {
+			return "", false
+		}
+	}
+	path := r.URL.Path
+	target := s.Rewrite
+	if s.Redirect != "" {
+		target = s.Redirect
+	}
+	switch s.MatchType {
+	case RouteExact:
+		if path != s.Path {
+			return "", false
+		}
+		return target, true
+	case RoutePrefix:
+		if !strings.HasPrefix(path, s.Path) {
+			return "", false
+		}
+		if rest := strings.TrimPrefix(path, s.Path); s.Rewrite != "" && rest != "" {
+			//replace the matched prefix and keep the rest of the path
+			return strings.TrimSuffix(target, "/") + "/" + strings.TrimPrefix(rest, "/"), true
+		}
+		return target, true
+	case RouteRegex:
+		m := s.pathReg.FindStringSubmatchIndex(path)
+		if m == nil {
+			return "", false
+		}
+		return string(s.pathReg.ExpandString(nil, target, path, m)), true
+	}
+	return "", false
+}
+
+//get the parsed route rules, the rules are parsed again when RouteRules is modified.
+//the write lock is only taken to parse the rules
+func (s *Host) GetRouteRules() []*RouteRule {
+	s.RLock()
+	rules, ok := s.routeRules, s.routeRulesStr == s.RouteRules
+	s.RUnlock()
+	if ok {
+		return rules
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.routeRulesStr != s.RouteRules {
+		var err error
+		if s.routeRules, err = ParseRouteRules(s.RouteRules); err != nil {
+			logs.Warn("the route rules of the host %s error %s", s.Host, err.Error())
+		}
+		s.routeRulesStr = s.RouteRules
+	}
+	return s.routeRules
+}
+
+//find the first rule matching the request
+func (s *Host) MatchRouteRule(r *http.Request) (*RouteRule, string) {
+	for _, rule := range s.GetRouteRules() {
+		if v, ok := rule.Match(r); ok {
+			return rule, v
+		}
+	}
+	return nil, ""
+}
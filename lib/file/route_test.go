@@ -0,0 +1,48 @@
+package file
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRouteRuleMatch(t *testing.T) {
+	rules, err := ParseRouteRules(`# comment
+prefix=/old redirect=https://a.proxy.com/new code=301
+regex=^/api/(.*)$ rewrite=/v2/$1
+prefix=/static rewrite=/assets
+exact=/ping header=X-Env:^beta$ respond=pong pong`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Host{routeRules: rules}
+	cases := []struct {
+		path, env, want string
+		code            int
+	}{
+		{"/old/a", "", "https://a.proxy.com/new", 301},
+		{"/api/user/1", "", "/v2/user/1", 200},
+		{"/static/js/a.js", "", "/assets/js/a.js", 200},
+		{"/static", "", "/assets", 200},
+		{"/ping", "beta", "", 200},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "http://a.proxy.com"+c.path, nil)
+		r.Header.Set("X-Env", c.env)
+		rule, v := h.MatchRouteRule(r)
+		if rule == nil || v != c.want || rule.Code != c.code {
+			t.Fatalf("path %s, got %v %s", c.path, rule, v)
+		}
+	}
+	r, _ := http.NewRequest("GET", "http://a.proxy.com/ping", nil)
+	if rule, _ := h.MatchRouteRule(r); rule != nil {
+		t.Fatal("header should not match")
+	}
+	if rules[3].Respond != "pong pong" {
+		t.Fatal("respond should take the rest of the line")
+	}
+	for _, s := range []string{"prefix=/a", "exact=/a redirect=/b code=200", "regex=( rewrite=/a", "foo=bar"} {
+		if _, err := ParseRouteRules(s); err == nil {
+			t.Fatalf("%s should be illegal", s)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package file
+
+import (
+	"time"
+)
+
+//the idle timeout of the udp sessions if the tunnel does not set it
+const defaultUdpTimeout = time.Minute * 10
+
+//the udp session is closed if no packet is sent or received within the timeout
+func (s *Tunnel) GetUdpTimeout() time.Duration {
+	if s.UdpTimeout <= 0 {
+		return defaultUdpTimeout
+	}
+	return time.Duration(s.UdpTimeout) * time.Second
+}
+
+//get a udp session, return false if the sessions reach the limit of the tunnel
+func (s *Tunnel) GetUdpSess() bool {
+	s.UdpStat.Lock()
+	defer s.UdpStat.Unlock()
+	if s.UdpMaxSess > 0 && s.UdpStat.NowSess >= s.UdpMaxSess {
+		s.UdpStat.RejectSess++
+		return false
+	}
+	s.UdpStat.NowSess++
+	s.UdpStat.TotalSess++
+	return true
+}
+
+//release the udp session got by GetUdpSess
+func (s *Tunnel) ReleaseUdpSess() {
+	s.UdpStat.Lock()
+	defer s.UdpStat.Unlock()
+	if s.UdpStat.NowSess > 0 {
+		s.UdpStat.NowSess--
+	}
+}
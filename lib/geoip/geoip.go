@@ -0,0 +1,303 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+//a reader of the MaxMind DB format, eg GeoLite2-Country.mmdb, only the country of the ip is looked up
+type Reader struct {
+	buf        []byte
+	data       decoder //the data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint //the node of ::/96 for the ipv4 in the ipv6 tree
+}
+
+var (
+	metadataStart = []byte("\xab\xcd\xefMaxMind.com")
+	errInvalid    = errors.New("invalid MaxMind DB file")
+)
+
+//open the database file, the whole file is read into the memory
+func Open(path string) (*Reader, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(b, metadataStart)
+	if i < 0 {
+		return nil, errInvalid
+	}
+	meta, _, err := decoder(b[i+len(metadataStart):]).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid
+	}
+	r := &Reader{buf: b}
+	r.nodeCount, _ = m["node_count"].(uint)
+	r.recordSize, _ = m["record_size"].(uint)
+	r.ipVersion, _ = m["ip_version"].(uint)
+	treeSize := r.nodeCount * r.recordSize / 4
+	if (r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32) || treeSize+16 > uint(i) {
+		return nil, errInvalid
+	}
+	r.data = b[treeSize+16 : i]
+	if r.ipVersion == 6 {
+		for n := 0; n < 96 && r.ipv4Start < r.nodeCount; n++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+//read the left or right record of the node
+func (r *Reader) readNode(node, bit uint) uint {
+	b := r.buf
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[node*8+bit*4:]))
+	}
+}
+
+//the iso code of the country of the ip, eg CN, the registered country is used if the country is unknown.
+//empty if the ip is not found
+func (r *Reader) Country(ip net.IP) string {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node, bits = ip4, r.ipv4Start, 32
+	} else if ip = ip.To16(); ip == nil || r.ipVersion == 4 {
+		return ""
+	}
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		node = r.readNode(node, uint(ip[i>>3]>>(7-uint(i&7))&1))
+	}
+	if node <= r.nodeCount {
+		return ""
+	}
+	//only the iso codes are decoded, the names in all languages are skipped
+	for _, key := range []string{"country", "registered_country"} {
+		if v, err := r.data.lookup(node-r.nodeCount-16, 0, []string{key, "iso_code"}); err == nil {
+			if code, ok := v.(string); ok && code != "" {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+//the max depth of the nested maps, arrays and pointers, the deeper data is invalid
+const maxDepth = 32
+
+//the data section, the offsets of the pointers are relative to it
+type decoder []byte
+
+//parse the control bytes of the value at the offset, return the type, the size and the offset after the control bytes.
+//the size of a pointer is the offset it points to
+func (d decoder) ctrl(off uint) (tp, size, next uint, err error) {
+	if off >= uint(len(d)) {
+		return 0, 0, 0, errInvalid
+	}
+	c := d[off]
+	off++
+	tp = uint(c >> 5)
+	if tp == 1 {
+		//pointer
+		size := uint(c>>3)&3 + 1
+		if off+size > uint(len(d)) {
+			return 0, 0, 0, errInvalid
+		}
+		p := uint(c & 7)
+		if size == 4 {
+			p = 0
+		}
+		for _, b := range d[off : off+size] {
+			p = p<<8 | uint(b)
+		}
+		p += [...]uint{0, 0, 2048, 526336, 0}[size]
+		return tp, p, off + size, nil
+	}
+	if tp == 0 {
+		//extended type
+		if off >= uint(len(d)) {
+			return 0, 0, 0, errInvalid
+		}
+		tp = 7 + uint(d[off])
+		off++
+	}
+	size = uint(c & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d)) {
+			return 0, 0, 0, errInvalid
+		}
+		size = 0
+		for _, b := range d[off : off+n] {
+			size = size<<8 | uint(b)
+		}
+		size += [...]uint{0, 29, 285, 65821}[n]
+		off += n
+	}
+	return tp, size, off, nil
+}
+
+//decode the value at the path of the maps at the offset, eg country.iso_code, the other values are skipped.
+//nil if the path is not found
+func (d decoder) lookup(off uint, depth int, path []string) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errInvalid
+	}
+	if len(path) == 0 {
+		v, _, err := d.decode(off, depth)
+		return v, err
+	}
+	tp, size, off, err := d.ctrl(off)
+	if err != nil {
+		return nil, err
+	}
+	if tp == 1 {
+		return d.lookup(size, depth+1, path)
+	}
+	if tp != 7 {
+		return nil, nil
+	}
+	for i := uint(0); i < size; i++ {
+		k, next, err := d.decode(off, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := k.(string); !ok {
+			return nil, errInvalid
+		} else if key == path[0] {
+			return d.lookup(next, depth+1, path[1:])
+		}
+		if off, err = d.skip(next, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+//skip the value at the offset without decoding it, return the offset after it
+func (d decoder) skip(off uint, depth int) (uint, error) {
+	if depth > maxDepth {
+		return 0, errInvalid
+	}
+	tp, size, off, err := d.ctrl(off)
+	if err != nil {
+		return 0, err
+	}
+	switch tp {
+	case 1, 14:
+		return off, nil
+	case 7, 11:
+		if tp == 7 {
+			size *= 2
+		}
+		for i := uint(0); i < size; i++ {
+			if off, err = d.skip(off, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return off, nil
+	}
+	if off+size > uint(len(d)) {
+		return 0, errInvalid
+	}
+	return off + size, nil
+}
+
+//decode the value at the offset, return the value and the offset after it.
+//maps are map[string]interface{}, arrays are []interface{} and unsigned integers are uint
+func (d decoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errInvalid
+	}
+	tp, size, off, err := d.ctrl(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch tp {
+	case 1:
+		v, _, err := d.decode(size, depth+1)
+		return v, off, err
+	case 7:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errInvalid
+			}
+			if m[key], off, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11:
+		var arr []interface{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr, off = append(arr, v), next
+		}
+		return arr, off, nil
+	case 14:
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(d)) {
+		return nil, 0, errInvalid
+	}
+	b := d[off : off+size]
+	off += size
+	switch tp {
+	case 2:
+		return string(b), off, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errInvalid
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	case 5, 6, 9, 10:
+		//the uint128 is truncated, it is not used by the country database
+		var n uint
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		return n, off, nil
+	case 8:
+		var n int32
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		return n, off, nil
+	}
+	return b, off, nil
+}
@@ -0,0 +1,55 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+)
+
+//testdata/country.mmdb has 1.2.3.0/24 in CN, 8.8.0.0/16 in US and 2001:db8::/32 registered in JP
+func TestCountry(t *testing.T) {
+	r, err := Open("testdata/country.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"1.2.3.4":        "CN",
+		"1.2.4.1":        "",
+		"8.8.8.8":        "US",
+		"::ffff:8.8.1.1": "US",
+		"2001:db8::1":    "JP",
+		"2001:db9::1":    "",
+	}
+	for ip, want := range cases {
+		if got := r.Country(net.ParseIP(ip)); got != want {
+			t.Fatalf("ip %s, got %q, want %q", ip, got, want)
+		}
+	}
+	if _, err := Open("geoip.go"); err == nil {
+		t.Fatal("the invalid database should not be opened")
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	//{"a": "b", "c": {"d": 1}}
+	d := decoder{0xe2, 0x41, 'a', 0x41, 'b', 0x41, 'c', 0xe1, 0x41, 'd', 0xa1, 0x01}
+	if v, err := d.lookup(0, 0, []string{"c", "d"}); err != nil || v != uint(1) {
+		t.Fatalf("got %v %v", v, err)
+	}
+	if v, err := d.lookup(0, 0, []string{"x"}); err != nil || v != nil {
+		t.Fatalf("got %v %v, the path should not be found", v, err)
+	}
+	if off, err := d.skip(0, 0); err != nil || off != uint(len(d)) {
+		t.Fatalf("skip to %d %v", off, err)
+	}
+	//the pointer to itself and the truncated data are invalid
+	for _, d := range []decoder{{0x20, 0x00}, {0xe1, 0x41, 'a', 0x20, 0x00}, {0xe1, 0x41}, {0x45, 'a'}} {
+		if _, _, err := d.decode(0, 0); err == nil {
+			t.Fatalf("decode %x should be invalid", []byte(d))
+		}
+	}
+	for _, d := range []decoder{{0x20, 0x00}, {0xe1, 0x41}, {0xe1, 0x41, 'a', 0xe1, 0x41, 'b', 0x45, 'c'}} {
+		if _, err := d.lookup(0, 0, []string{"b"}); err == nil {
+			t.Fatalf("lookup %x should be invalid", []byte(d))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package inspect
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//a request and its response captured by the inspector of the host
+type Exchange struct {
+	Id            int64       `json:"id"`
+	HostId        int         `json:"host_id"`
+	Time          time.Time   `json:"time"`
+	RemoteIp      string      `json:"remote_ip"`
+	Method        string      `json:"method"`
+	Host          string      `json:"host"`
+	Url           string      `json:"url"`
+	Proto         string      `json:"proto"`
+	ReqHeader     http.Header `json:"req_header"`
+	ReqBody       string      `json:"req_body"`
+	ReqTruncated  bool        `json:"req_truncated"`
+	Status        int         `json:"status"`
+	RespHeader    http.Header `json:"resp_header"`
+	RespBody      string      `json:"resp_body"`
+	RespTruncated bool        `json:"resp_truncated"`
+	Target        string      `json:"target"`
+	Latency       float64     `json:"latency_ms"`
+	Replay        bool        `json:"replay"`
+
+	reqBody    *Body
+	respBody   *Body
+	sync.Mutex `json:"-"`
+}
+
+//the body read through is kept up to the max size
+type Body struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if remain := b.max - b.buf.Len(); remain >= n {
+			b.buf.Write(p[:n])
+		} else {
+			if remain > 0 {
+				b.buf.Write(p[:remain])
+			}
+			b.truncated = true
+		}
+	}
+	return n, err
+}
+
+var (
+	size     int
+	bodySize int
+	recent   = make(map[int][]*Exchange)
+	seq      int64
+	lock     sync.Mutex
+)
+
+//set the inspector, size is the exchanges kept for each host and bodySize is the max bytes of a body kept
+func Init(inspectSize, inspectBodySize int) {
+	lock.Lock()
+	defer lock.Unlock()
+	size, bodySize = inspectSize, inspectBodySize
+}
+
+//whether the exchanges of the host should be captured, hostInspect is the inspector setting of the host
+func Enabled(hostInspect bool) bool {
+	return hostInspect && size > 0
+}
+
+//start capturing the request before it is sent to the target, remoteIp is the ip of the visitor
+func Capture(r *http.Request, hostId int, remoteIp string) *Exchange {
+	e := &Exchange{
+		HostId:    hostId,
+		Time:      time.Now(),
+		RemoteIp:  remoteIp,
+		Method:    r.Method,
+		Host:      r.Host,
+		Url:       r.URL.RequestURI(),
+		Proto:     r.Proto,
+		ReqHeader: r.Header.Clone(),
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		e.reqBody = &Body{ReadCloser: r.Body, max: bodySize}
+		r.Body = e.reqBody
+	}
+	return e
+}
+
+//the request has been sent to the target, the captured body is kept
+func (e *Exchange) RequestSent() {
+	e.Lock()
+	defer e.Unlock()
+	if e.reqBody != nil {
+		e.ReqBody, e.ReqTruncated = e.reqBody.buf.String(), e.reqBody.truncated
+	}
+}
+
+//start capturing the response before it is written to the visitor
+func (e *Exchange) CaptureResponse(resp *http.Response) {
+	e.Lock()
+	defer e.Unlock()
+	e.Status = resp.StatusCode
+	e.RespHeader = resp.Header.Clone()
+	if resp.Body != nil && resp.Body != http.NoBody {
+		e.respBody = &Body{ReadCloser: resp.Body, max: bodySize}
+		resp.Body = e.respBody
+	}
+}
+
+//the response has been written to the visitor, keep the exchange for the web
+func Add(e *Exchange, target string) {
+	e.Lock()
+	e.Target = target
+	e.Latency = float64(time.Since(e.Time)) / float64(time.Millisecond)
+	if e.respBody != nil {
+		e.RespBody, e.RespTruncated = e.respBody.buf.String(), e.respBody.truncated
+	}
+	e.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+	if size <= 0 {
+		return
+	}
+	seq++
+	e.Id = seq
+	arr := append(recent[e.HostId], e)
+	if len(arr) > size {
+		arr = arr[len(arr)-size:]
+	}
+	recent[e.HostId] = arr
+}
+
+func (e *Exchange) clone() *Exchange {
+	e.Lock()
+	defer e.Unlock()
+	return &Exchange{
+		Id:            e.Id,
+		HostId:        e.HostId,
+		Time:          e.Time,
+		RemoteIp:      e.RemoteIp,
+		Method:        e.Method,
+		Host:          e.Host,
+		Url:           e.Url,
+		Proto:         e.Proto,
+		ReqHeader:     e.ReqHeader,
+		ReqBody:       e.ReqBody,
+		ReqTruncated:  e.ReqTruncated,
+		Status:        e.Status,
+		RespHeader:    e.RespHeader,
+		RespBody:      e.RespBody,
+		RespTruncated: e.RespTruncated,
+		Target:        e.Target,
+		Latency:       e.Latency,
+		Replay:        e.Replay,
+	}
+}
+
+//get the recent exchanges of the host after the seq, and the latest seq
+func Recent(hostId int, after int64) ([]*Exchange, int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	var arr []*Exchange
+	for _, e := range recent[hostId] {
+		if e.Id > after {
+			arr = append(arr, e.clone())
+		}
+	}
+	return arr, seq
+}
+
+//get the exchange of the host by id, nil if it is not kept any more
+func Get(hostId int, id int64) *Exchange {
+	lock.Lock()
+	defer lock.Unlock()
+	for _, e := range recent[hostId] {
+		if e.Id == id {
+			return e.clone()
+		}
+	}
+	return nil
+}
+
+//remove the exchanges of the deleted host
+func Remove(hostId int) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(recent, hostId)
+}
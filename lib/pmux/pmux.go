@@ -60,11 +60,12 @@ func (pMux *PortMux) Start() error {
 	if err != nil {
 		return err
 	}
-	pMux.Listener, err = net.ListenTCP("tcp", tcpAddr)
+	l, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
 		logs.Error(err)
 		os.Exit(0)
 	}
+	pMux.Listener = common.NewProxyProtocolListener(l)
 	go func() {
 		for {
 			conn, err := pMux.Listener.Accept()
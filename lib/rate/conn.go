@@ -16,10 +16,11 @@ func NewRateConn(conn io.ReadWriteCloser, rate *Rate) io.ReadWriteCloser {
 	}
 }
 
+//the conn is the connection to the target, so the bytes read are the export flow
 func (s *rateConn) Read(b []byte) (n int, err error) {
 	n, err = s.conn.Read(b)
 	if s.rate != nil {
-		s.rate.Get(int64(n))
+		s.rate.GetOut(int64(n))
 	}
 	return
 }
@@ -27,7 +28,7 @@ func (s *rateConn) Read(b []byte) (n int, err error) {
 func (s *rateConn) Write(b []byte) (n int, err error) {
 	n, err = s.conn.Write(b)
 	if s.rate != nil {
-		s.rate.Get(int64(n))
+		s.rate.GetIn(int64(n))
 	}
 	return
 }
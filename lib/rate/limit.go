@@ -0,0 +1,92 @@
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+//limit the request rate and the concurrent connections of each ip
+type IpLimiter struct {
+	buckets   map[string]*ipBucket
+	conns     map[string]int
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewIpLimiter() *IpLimiter {
+	return &IpLimiter{
+		buckets:   make(map[string]*ipBucket),
+		conns:     make(map[string]int),
+		lastSweep: time.Now(),
+	}
+}
+
+//whether a request of the ip is allowed, rate is the requests per second and burst is the size of the bucket,
+//burst is the rate if not set
+func (l *IpLimiter) Allow(ip string, rate, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(now, time.Duration(burst)*time.Second/time.Duration(rate))
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{tokens: float64(burst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//remove the buckets which are full again, at most once a minute
+func (l *IpLimiter) sweep(now time.Time, refill time.Duration) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) > refill {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+//get a connection of the ip, return false if the connections of the ip reach the max
+func (l *IpLimiter) GetConn(ip string, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if max > 0 && l.conns[ip] >= max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+//release a connection of the ip
+func (l *IpLimiter) ReleaseConn(ip string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
@@ -1,81 +1,189 @@
 package rate
 
 import (
-	"sync/atomic"
+	"encoding/json"
+	"sync"
 	"time"
 )
 
+//the rate limit of the inlet flow, the export flow and the sum of them, the limits of the parent
+//are also applied, eg the rate of the tunnel is the child of the rate of the client.
+//the bytes are reserved from the buckets in order, so the waiting connections share the rate fairly
 type Rate struct {
-	bucketSize        int64
-	bucketSurplusSize int64
-	bucketAddSize     int64
-	stopChan          chan bool
-	NowRate           int64
+	total  *bucket //nil means unlimited
+	in     *bucket
+	out    *bucket
+	parent *Rate
+
+	count       int64 //bytes since windowStart
+	windowStart time.Time
+	nowRate     int64
+	inFlow      int64 //bytes of the inlet flow since created
+	outFlow     int64
+	sync.Mutex
 }
 
-func NewRate(addSize int64) *Rate {
-	return &Rate{
-		bucketSize:        addSize * 2,
-		bucketSurplusSize: 0,
-		bucketAddSize:     addSize,
-		stopChan:          make(chan bool),
+//a token bucket refilled by the time passed, the tokens may be negative when the bytes are reserved in advance
+type bucket struct {
+	limit  float64 //bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit, burst int64) *bucket {
+	if limit <= 0 {
+		return nil
 	}
+	if burst <= 0 {
+		burst = limit
+	}
+	return &bucket{limit: float64(limit), burst: float64(burst), tokens: float64(burst), last: time.Now()}
 }
 
-func (s *Rate) Start() {
-	go s.session()
+//reserve the bytes and return how long to wait for them
+func (b *bucket) reserve(now time.Time, size int64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.limit
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens -= float64(size)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit * float64(time.Second))
 }
 
-func (s *Rate) add(size int64) {
-	if res := s.bucketSize - s.bucketSurplusSize; res < s.bucketAddSize {
-		atomic.AddInt64(&s.bucketSurplusSize, res)
-		return
+//the rate of the sum of the inlet and export flow in bytes per second, 0 means unlimited
+func NewRate(addSize int64) *Rate {
+	return NewLimitRate(addSize, 0, 0, 0)
+}
+
+//the rate of the total, inlet and export flow in bytes per second, 0 means unlimited.
+//burst is the bytes can be sent at once, one second of each limit by default
+func NewLimitRate(total, in, out, burst int64) *Rate {
+	return &Rate{
+		total:       newBucket(total, burst),
+		in:          newBucket(in, burst),
+		out:         newBucket(out, burst),
+		windowStart: time.Now(),
 	}
-	atomic.AddInt64(&s.bucketSurplusSize, size)
 }
 
-//回桶
-func (s *Rate) ReturnBucket(size int64) {
-	s.add(size)
+//modify the limits without losing the parent and the flow, eg the global rate shared by all clients
+func (s *Rate) SetLimit(total, in, out, burst int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.total, s.in, s.out = newBucket(total, burst), newBucket(in, burst), newBucket(out, burst)
 }
 
-//停止
-func (s *Rate) Stop() {
-	s.stopChan <- true
+//the limits of the parent are applied besides its own
+func (s *Rate) SetParent(parent *Rate) {
+	s.Lock()
+	defer s.Unlock()
+	s.parent = parent
 }
 
+func (s *Rate) getParent() *Rate {
+	s.Lock()
+	defer s.Unlock()
+	return s.parent
+}
+
+const (
+	dirAny = iota
+	dirIn
+	dirOut
+)
+
+//wait for the bytes regardless of the direction
 func (s *Rate) Get(size int64) {
-	if s.bucketSurplusSize >= size {
-		atomic.AddInt64(&s.bucketSurplusSize, -size)
+	s.wait(size, dirAny)
+}
+
+//wait for the bytes of the inlet flow, from the visitor to the target
+func (s *Rate) GetIn(size int64) {
+	s.wait(size, dirIn)
+}
+
+//wait for the bytes of the export flow, from the target to the visitor
+func (s *Rate) GetOut(size int64) {
+	s.wait(size, dirOut)
+}
+
+func (s *Rate) wait(size int64, dir int) {
+	if size <= 0 {
 		return
 	}
-	ticker := time.NewTicker(time.Millisecond * 100)
-	for {
-		select {
-		case <-ticker.C:
-			if s.bucketSurplusSize >= size {
-				atomic.AddInt64(&s.bucketSurplusSize, -size)
-				ticker.Stop()
-				return
-			}
+	now := time.Now()
+	var delay time.Duration
+	for r := s; r != nil; r = r.getParent() {
+		if d := r.reserve(now, size, dir); d > delay {
+			delay = d
 		}
 	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (s *Rate) reserve(now time.Time, size int64, dir int) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	s.record(now, size)
+	delay := s.total.reserve(now, size)
+	var d time.Duration
+	switch dir {
+	case dirIn:
+		s.inFlow += size
+		d = s.in.reserve(now, size)
+	case dirOut:
+		s.outFlow += size
+		d = s.out.reserve(now, size)
+	}
+	if d > delay {
+		delay = d
+	}
+	return delay
 }
 
-func (s *Rate) session() {
-	ticker := time.NewTicker(time.Second * 1)
-	for {
-		select {
-		case <-ticker.C:
-			if rs := s.bucketAddSize - s.bucketSurplusSize; rs > 0 {
-				s.NowRate = rs
-			} else {
-				s.NowRate = s.bucketSize - s.bucketSurplusSize
-			}
-			s.add(s.bucketAddSize)
-		case <-s.stopChan:
-			ticker.Stop()
-			return
+//count the bytes to calculate the current rate every second
+func (s *Rate) record(now time.Time, size int64) {
+	if elapsed := now.Sub(s.windowStart); elapsed >= time.Second {
+		if elapsed < time.Second*2 {
+			s.nowRate = int64(float64(s.count) / elapsed.Seconds())
+		} else {
+			s.nowRate = 0
 		}
+		s.count = 0
+		s.windowStart = now
+	}
+	s.count += size
+}
+
+//the bytes per second passed in the last second
+func (s *Rate) NowRate() int64 {
+	s.Lock()
+	defer s.Unlock()
+	if time.Since(s.windowStart) >= time.Second*2 {
+		return 0
 	}
+	return s.nowRate
+}
+
+//the bytes of the inlet and export flow passed since created
+func (s *Rate) Flow() (in, out int64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.inFlow, s.outFlow
+}
+
+func (s *Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int64{"NowRate": s.NowRate()})
 }
@@ -0,0 +1,99 @@
+package rate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateBurst(t *testing.T) {
+	now := time.Now()
+	r := NewLimitRate(1000, 0, 0, 5000)
+	if d := r.reserve(now, 5000, dirAny); d != 0 {
+		t.Fatalf("the burst should be sent at once, wait %s", d)
+	}
+	if d := r.reserve(now, 1000, dirAny); d != time.Second {
+		t.Fatalf("wait %s, want 1s", d)
+	}
+	//the tokens are refilled by the time passed
+	if d := r.reserve(now.Add(3*time.Second), 1000, dirAny); d != 0 {
+		t.Fatalf("wait %s after refilled", d)
+	}
+	//the burst is one second of the limit by default
+	r = NewRate(1000)
+	if d := r.reserve(now, 1000, dirAny); d != 0 {
+		t.Fatalf("wait %s, want 0", d)
+	}
+	if d := r.reserve(now, 500, dirAny); d != 500*time.Millisecond {
+		t.Fatalf("wait %s, want 500ms", d)
+	}
+	//the tokens are not more than the burst after a long idle
+	if d := r.reserve(now.Add(time.Hour), 1500, dirAny); d != 500*time.Millisecond {
+		t.Fatalf("wait %s, want 500ms", d)
+	}
+}
+
+func TestRateDirection(t *testing.T) {
+	now := time.Now()
+	r := NewLimitRate(0, 1000, 2000, 0)
+	if d := r.reserve(now, 1000, dirIn); d != 0 {
+		t.Fatalf("wait %s, want 0", d)
+	}
+	if d := r.reserve(now, 1000, dirIn); d != time.Second {
+		t.Fatalf("the inlet flow should wait 1s, wait %s", d)
+	}
+	if d := r.reserve(now, 2000, dirOut); d != 0 {
+		t.Fatalf("the export flow should not be limited by the inlet limit, wait %s", d)
+	}
+	if d := r.reserve(now, 10000, dirAny); d != 0 {
+		t.Fatalf("the total flow is unlimited, wait %s", d)
+	}
+	//both the total and the direction limits are applied
+	r = NewLimitRate(1000, 0, 2000, 0)
+	if d := r.reserve(now, 2000, dirOut); d != time.Second {
+		t.Fatalf("the total limit should be applied, wait %s", d)
+	}
+}
+
+func TestRateParent(t *testing.T) {
+	parent := NewRate(10000)
+	child := NewRate(0)
+	child.SetParent(parent)
+	start := time.Now()
+	child.GetIn(10000)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("the burst of the parent should be sent at once")
+	}
+	child.GetOut(1000)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("the limit of the parent should be applied, wait %s", d)
+	}
+	//the parent is shared by the children
+	other := NewLimitRate(0, 0, 0, 0)
+	other.SetParent(parent)
+	start = time.Now()
+	other.Get(1000)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("the other child should wait for the parent, wait %s", d)
+	}
+}
+
+func TestRateFlow(t *testing.T) {
+	r := NewRate(0)
+	r.GetIn(100)
+	r.GetIn(200)
+	r.GetOut(50)
+	r.Get(1000)
+	if in, out := r.Flow(); in != 300 || out != 50 {
+		t.Fatalf("flow %d %d, want 300 50", in, out)
+	}
+	//the flow of the child is also counted by the parent
+	child := NewRate(0)
+	child.SetParent(r)
+	child.GetOut(50)
+	if in, out := r.Flow(); in != 300 || out != 100 {
+		t.Fatalf("flow %d %d of the parent, want 300 100", in, out)
+	}
+	if r.NowRate() != 0 {
+		t.Fatal("the rate of the first second is not calculated")
+	}
+}
@@ -24,19 +24,17 @@ type NetBridge interface {
 
 //BaseServer struct
 type BaseServer struct {
-	id           int
-	bridge       NetBridge
-	task         *file.Tunnel
-	errorContent []byte
+	id     int
+	bridge NetBridge
+	task   *file.Tunnel
 	sync.Mutex
 }
 
 func NewBaseServer(bridge *bridge.Bridge, task *file.Tunnel) *BaseServer {
 	return &BaseServer{
-		bridge:       bridge,
-		task:         task,
-		errorContent: nil,
-		Mutex:        sync.Mutex{},
+		bridge: bridge,
+		task:   task,
+		Mutex:  sync.Mutex{},
 	}
 }
 
@@ -56,12 +54,6 @@ func (s *BaseServer) FlowAddHost(host *file.Host, in, out int64) {
 	host.Flow.InletFlow += in
 }
 
-//write fail bytes to the connection
-func (s *BaseServer) writeConnFail(c net.Conn) {
-	c.Write([]byte(common.ConnectionFailBytes))
-	c.Write(s.errorContent)
-}
-
 //auth check
 func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 	if u != "" && p != "" && !common.CheckAuth(r, u, p) {
@@ -72,21 +64,128 @@ func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 	return nil
 }
 
-//check flow limit of the client ,and decrease the allow num of client
-func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
-	if client.Flow.FlowLimit > 0 && (client.Flow.FlowLimit<<20) < (client.Flow.ExportFlow+client.Flow.InletFlow) {
-		return errors.New("Traffic exceeded")
+//whether the visitors of the task need the username and password
+func (s *BaseServer) needAuth() bool {
+	return (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") || (s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0)
+}
+
+//check the username and password by the multi account of the task, or by the client if not set
+func (s *BaseServer) checkAccount(user, pass string) bool {
+	if s.task.MultiAccount != nil {
+		return s.task.MultiAccount.Check(user, pass)
+	}
+	return user == s.task.Client.Cnf.U && pass == s.task.Client.Cnf.P
+}
+
+//the flow of the connection of the account, it is added to the account and the task as it passes,
+//the returned func releases the connection of the account. the task flow is returned if the account is not one of the multi account
+func (s *BaseServer) accountFlow(user string) (*file.Flow, func()) {
+	account := s.task.MultiAccount
+	if user == "" || account == nil {
+		return s.task.Flow, func() {}
+	}
+	return account.GetConn(user, s.task.Flow), func() {
+		account.ReleaseConn(user)
+	}
+}
+
+//whether the destination is allowed by the acl of the task and the address sent to the client, the denied one is logged
+func (s *BaseServer) allowDest(addr string, c net.Conn) (string, bool) {
+	if dest, ok := s.task.AllowDest(addr); ok {
+		return dest, true
+	}
+	logs.Warn("client id %d, task id %d, the destination %s is denied by the acl, remote address %s", s.task.Client.Id, s.task.Id, addr, c.RemoteAddr())
+	return addr, false
+}
+
+//serve the http proxy request of the connection
+func (s *BaseServer) dealHttpProxy(c *conn.Conn) error {
+	_, addr, rb, err, r := c.GetHost()
+	if err != nil {
+		c.Close()
+		logs.Info(err)
+		return err
+	}
+	var user string
+	var ok bool
+	if s.needAuth() {
+		var pass string
+		if user, pass, ok = common.GetAuth(r); !ok || !s.checkAccount(user, pass) {
+			c.Write([]byte(common.UnauthorizedBytes))
+			c.Close()
+			return errors.New("401 Unauthorized")
+		}
+	}
+	if addr, ok = s.allowDest(addr, c.Conn); !ok {
+		c.Write([]byte(common.ForbiddenBytes))
+		c.Close()
+		return errors.New("403 Forbidden")
+	}
+	if r.Method == "CONNECT" {
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		rb = nil
+	}
+	flow, release := s.accountFlow(user)
+	defer release()
+	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, flow, s.task.Target.LocalProxy, conn.LinkProxyProtocol(s.task.Target.ProxyProtocol))
+}
+
+var (
+	errTrafficExceeded     = errors.New("Traffic exceeded")
+	errConnExceeded        = errors.New("Connections exceed the current client limit")
+	errTaskTrafficExceeded = errors.New("Traffic exceeded the limit of the tunnel or host")
+	errTaskConnExceeded    = errors.New("Connections exceed the limit of the tunnel or host")
+	errGlobalFlowExceeded  = errors.New("Traffic exceeded the global monthly limit")
+)
+
+//check flow limit of the client and the tunnel or host, and decrease the allow num of them.
+//the connection is released by ReleaseConn
+func (s *BaseServer) CheckFlowAndConnNum(client *file.Client, flow *file.Flow, limit *file.Limit) error {
+	if file.GetGlobal().Exceeded() {
+		return errGlobalFlowExceeded
+	}
+	if client.Flow.Exceeded() {
+		return errTrafficExceeded
+	}
+	if flow.Exceeded() {
+		return errTaskTrafficExceeded
 	}
 	if !client.GetConn() {
-		return errors.New("Connections exceed the current client limit")
+		return errConnExceeded
+	}
+	if !limit.GetConn() {
+		client.AddConn()
+		return errTaskConnExceeded
 	}
 	return nil
 }
 
+//release the connection got by CheckFlowAndConnNum
+func (s *BaseServer) ReleaseConn(client *file.Client, limit *file.Limit) {
+	client.AddConn()
+	limit.ReleaseConn()
+}
+
 //create a new connection and start bytes copying
-func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string, rb []byte, tp string, f func(), flow *file.Flow, localProxy bool) error {
-	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy)
-	if target, err := s.bridge.SendLinkInfo(client.Id, link, s.task); err != nil {
+func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string, rb []byte, tp string, f func(), flow *file.Flow, localProxy bool, opts ...conn.Option) error {
+	return s.dealClient(c, client, addr, nil, &s.task.Limit, rb, tp, f, flow, localProxy, opts...)
+}
+
+//select an address of the target by the load balancing strategy, then create a new connection and start bytes copying.
+//limit is the limit of the tunnel or host
+func (s *BaseServer) DealTarget(c *conn.Conn, client *file.Client, target *file.Target, limit *file.Limit, rb []byte, flow *file.Flow) error {
+	addr, err := target.GetTarget(common.GetIpByAddr(c.Conn.RemoteAddr().String()), "")
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer target.ReleaseTarget(addr)
+	return s.dealClient(c, client, addr, target, limit, rb, common.CONN_TCP, nil, flow, target.LocalProxy, conn.LinkProxyProtocol(target.ProxyProtocol))
+}
+
+func (s *BaseServer) dealClient(c *conn.Conn, client *file.Client, addr string, t *file.Target, limit *file.Limit, rb []byte, tp string, f func(), flow *file.Flow, localProxy bool, opts ...conn.Option) error {
+	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy, opts...)
+	if target, err := s.sendLinkInfo(client.Id, link, s.task, t); err != nil {
 		logs.Warn("get connection from client id %d  error %s", client.Id, err.Error())
 		c.Close()
 		return err
@@ -94,7 +193,27 @@ func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 		if f != nil {
 			f()
 		}
-		conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flow, true, rb)
+		//the target closed after the visitor is not a failure of it
+		visitor := conn.NewReadErrConn(c.Conn, func() { conn.CancelReport(target) })
+		conn.CopyWaitGroup(target, visitor, link.Crypt, link.Compress, limit.GetRate(client.Rate), flow, true, rb)
 	}
 	return nil
 }
+
+//get the connection of the link from the bridge, the result of connecting to the target is reported for outlier detection
+func (s *BaseServer) sendLinkInfo(clientId int, link *conn.Link, task *file.Tunnel, t *file.Target) (net.Conn, error) {
+	target, err := s.bridge.SendLinkInfo(clientId, link, task)
+	if t == nil || (err != nil && !link.LocalProxy) {
+		return target, err
+	}
+	report := func(ok bool) {
+		if t.ReportTarget(link.Host, ok) {
+			logs.Warn("the target %s fails continuously, ejected by outlier detection", link.Host)
+		}
+	}
+	if link.LocalProxy {
+		report(err == nil)
+		return target, err
+	}
+	return conn.NewFirstReadConn(target, report), nil
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+//the data of the error page template
+type errorPage struct {
+	Code      int
+	Status    string
+	Message   string
+	Host      string
+	RequestId string
+	Time      string
+}
+
+var errorMessages = map[int]string{
+	http.StatusForbidden:          "A valid client certificate is required.",
+	http.StatusNotFound:           "The host is not found on this server.",
+	http.StatusTooManyRequests:    "Too many requests, please try again later.",
+	http.StatusBadGateway:         "The client of the host is offline.",
+	http.StatusServiceUnavailable: "The host is unavailable now.",
+	http.StatusGatewayTimeout:     "The target of the host is unreachable.",
+}
+
+var defaultErrorPage = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>{{.Code}} {{.Status}}</title></head>
+<body>{{.Code}} {{.Status}}<br>{{.Message}}<br>request id: {{.RequestId}}</body>
+</html>`))
+
+var (
+	errorPages     = make(map[int]*template.Template)
+	errorPagesLock sync.RWMutex
+)
+
+//load the global error pages, web/static/page/error.html is used for all errors,
+//error_<code>.html is used for the code if exists
+func loadErrorPages() {
+	dir := filepath.Join(common.GetRunPath(), "web", "static", "page")
+	pages := make(map[int]*template.Template)
+	for code := range errorMessages {
+		for _, name := range []string{"error_" + strconv.Itoa(code) + ".html", "error.html"} {
+			if b, err := common.ReadAllFromFile(filepath.Join(dir, name)); err == nil {
+				if t, err := template.New(name).Parse(string(b)); err != nil {
+					logs.Error("parse error page %s error %s", name, err)
+				} else {
+					pages[code] = t
+					break
+				}
+			}
+		}
+	}
+	errorPagesLock.Lock()
+	errorPages = pages
+	errorPagesLock.Unlock()
+}
+
+//write the error page of the code to the visitor, the page of the host is used if set.
+//the request id is shown in the page and the log, start is the time the request read
+func writeErrorPage(c io.Writer, r *http.Request, host *file.Host, code int, reason string, start time.Time) {
+	page := &errorPage{
+		Code:      code,
+		Status:    http.StatusText(code),
+		Message:   errorMessages[code],
+		Host:      r.Host,
+		RequestId: crypt.GetRandomString(16),
+		Time:      time.Now().Format("2006-01-02 15:04:05"),
+	}
+	logs.Notice("request id %s, %s request, method %s, host %s, url %s, remote address %s, return %d, %s",
+		page.RequestId, r.URL.Scheme, r.Method, r.Host, r.URL.Path, r.RemoteAddr, code, reason)
+	var t *template.Template
+	if host != nil && host.ErrorPage != "" {
+		var err error
+		if t, err = template.New("host").Parse(host.ErrorPage); err != nil {
+			logs.Warn("parse error page of host %s error %s", host.Host, err)
+			t = nil
+		}
+	}
+	if t == nil {
+		errorPagesLock.RLock()
+		t = errorPages[code]
+		errorPagesLock.RUnlock()
+	}
+	if t == nil {
+		t = defaultErrorPage
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, page); err != nil {
+		buf.Reset()
+		defaultErrorPage.Execute(&buf, page)
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Request-Id", page.RequestId)
+	header.Set("Connection", "close")
+	n, _ := writeResponse(c, r, code, header, buf.String())
+	if host != nil {
+		host.Flow.Add(0, int64(n))
+	}
+	logAccess(r, host, "", code, n, start, page.RequestId)
+}
@@ -2,26 +2,42 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/accesslog"
 	"ehang.io/nps/lib/cache"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/inspect"
 	"ehang.io/nps/server/connection"
 	"github.com/astaxie/beego/logs"
 )
 
+//the timeout of replaying a captured request
+const replayTimeout = 30 * time.Second
+
+//the request forwarded to the target, the responses are matched by the order of the requests
+type forwardRequest struct {
+	r           *http.Request //the request of the visitor, before the host and header changed
+	start       time.Time
+	requestTime time.Time
+	validating  *cache.HttpEntry
+	exchange    *inspect.Exchange
+}
+
 type httpServer struct {
 	BaseServer
 	httpPort      int
@@ -29,13 +45,11 @@ type httpServer struct {
 	httpServer    *http.Server
 	httpsServer   *http.Server
 	httpsListener net.Listener
-	useCache      bool
 	addOrigin     bool
-	cache         *cache.Cache
-	cacheLen      int
+	cache         *cache.HttpCache
 }
 
-func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, useCache bool, cacheLen int, addOrigin bool) *httpServer {
+func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, useCache bool, cacheLen int, cacheSize int64, addOrigin bool) *httpServer {
 	httpServer := &httpServer{
 		BaseServer: BaseServer{
 			task:   c,
@@ -44,21 +58,17 @@ func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, use
 		},
 		httpPort:  httpPort,
 		httpsPort: httpsPort,
-		useCache:  useCache,
-		cacheLen:  cacheLen,
 		addOrigin: addOrigin,
 	}
 	if useCache {
-		httpServer.cache = cache.New(cacheLen)
+		httpServer.cache = cache.NewHttpCache(cacheLen, cacheSize)
 	}
 	return httpServer
 }
 
 func (s *httpServer) Start() error {
 	var err error
-	if s.errorContent, err = common.ReadAllFromFile(filepath.Join(common.GetRunPath(), "web", "static", "page", "error.html")); err != nil {
-		s.errorContent = []byte("nps 404")
-	}
+	loadErrorPages()
 	if s.httpPort > 0 {
 		s.httpServer = s.NewServer(s.httpPort, "http")
 		go func() {
@@ -82,7 +92,7 @@ func (s *httpServer) Start() error {
 				logs.Error(err)
 				os.Exit(0)
 			}
-			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.useCache, s.cacheLen).Start())
+			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.cache).Start())
 		}()
 	}
 	return nil
@@ -101,6 +111,14 @@ func (s *httpServer) Close() error {
 	return nil
 }
 
+//purge the http cache of the host whose path begins with the path, empty host means all hosts
+func (s *httpServer) PurgeCache(host, path string) int {
+	if s.cache == nil {
+		return 0
+	}
+	return s.cache.Purge(host, path)
+}
+
 func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -126,103 +144,282 @@ func (s *httpServer) handleHttp(c *conn.Conn, r *http.Request) {
 		lenConn    *conn.LenConn
 		isReset    bool
 		wg         sync.WaitGroup
+
+		validating  *cache.HttpEntry
+		certSubject string
+		forwarded   chan *forwardRequest
+		req         *forwardRequest
+		start       = time.Now()
+		connHost    *file.Host //the host holding the connection got by CheckFlowAndConnNum
 	)
 	defer func() {
+		if connHost != nil {
+			s.ReleaseConn(connHost.Client, &connHost.Limit)
+		}
+		if targetAddr != "" {
+			host.Target.ReleaseTarget(targetAddr)
+		}
 		if connClient != nil {
 			connClient.Close()
-		} else {
-			s.writeConnFail(c.Conn)
 		}
 		c.Close()
 	}()
+	//select the target and connect to it, only when a request of the host is forwarded
+	dial := func() bool {
+		if targetAddr, err = host.Target.GetTarget(common.GetIpByAddr(r.RemoteAddr), getStickyCookie(r)); err != nil {
+			logs.Warn(err.Error())
+			writeErrorPage(c, r, host, http.StatusBadGateway, err.Error(), start)
+			return false
+		}
+		lk = newHostLink(host, targetAddr, r.RemoteAddr)
+		if target, err = s.sendLinkInfo(host.Client.Id, lk, nil, host.Target); err != nil {
+			logs.Notice("connect to target %s error %s", lk.Host, err)
+			//the local proxy dials the target directly, otherwise the client is not available
+			if lk.LocalProxy {
+				writeErrorPage(c, r, host, http.StatusGatewayTimeout, err.Error(), start)
+			} else {
+				writeErrorPage(c, r, host, http.StatusBadGateway, err.Error(), start)
+			}
+			return false
+		}
+		connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.GetRate(host.Client.Rate), true)
+		//the requests forwarded to this target, a new target has its own queue
+		forwarded = make(chan *forwardRequest, 16)
+		//the sticky cookie of the target, set to the response when the request does not carry it
+		sticky := file.StickyValue(targetAddr)
+		//read from inc-client
+		go func(connClient io.ReadWriteCloser, forwarded chan *forwardRequest, host *file.Host, lk *conn.Link) {
+			wg.Add(1)
+			isReset = false
+			defer connClient.Close()
+			defer func() {
+				wg.Done()
+				if !isReset {
+					c.Close()
+				}
+			}()
+			var req *forwardRequest
+			br := bufio.NewReader(connClient)
+			for {
+				//the request is queued before written, so it is there when the response arrives
+				_, err := br.Peek(1)
+				if req == nil {
+					select {
+					case req = <-forwarded:
+					default:
+					}
+				}
+				if err != nil {
+					//the target is closed before responding, eg: the client can not connect to it
+					if req != nil && !isReset {
+						writeErrorPage(c, req.r, host, http.StatusGatewayTimeout, "the target closed without response", req.start)
+					}
+					return
+				} else if req == nil {
+					//the response without request, eg: the timeout response of an idle connection
+					return
+				}
+				resp, err := http.ReadResponse(br, req.r)
+				if err != nil {
+					// if there got broken pipe, http.ReadResponse will get a nil
+					if !isReset {
+						writeErrorPage(c, req.r, host, http.StatusGatewayTimeout, "the target closed without response", req.start)
+					}
+					return
+				}
+				r := req.r
+				common.ChangeResponseHeader(resp.Header, host.RespHeader)
+				//the response is stored before modified for the visitor
+				var recorder *cache.BodyRecorder
+				var storeResp *http.Response
+				if s.cache != nil && !host.NoCache {
+					if req.validating != nil && resp.StatusCode == http.StatusNotModified {
+						//the stored response is still valid, return it to the visitor
+						resp.Body.Close()
+						e := s.cache.Update(r, req.validating, resp, req.requestTime)
+						req.validating.RemoveConditions(r)
+						resp = e.Response(r)
+					} else if s.cache.Storable(r, resp) {
+						storeResp = &http.Response{StatusCode: resp.StatusCode, Header: resp.Header.Clone()}
+						recorder = cache.NewBodyRecorder(resp.Body, s.cache.MaxObjectSize())
+						resp.Body = recorder
+					}
+				}
+				common.SetCorsHeader(resp.Header, r, host.CorsOrigin)
+				setHstsHeader(resp.Header, r, host)
+				if host.Target.Strategy == file.LbCookie && getStickyCookie(r) != sticky {
+					resp.Header.Add("Set-Cookie", (&http.Cookie{Name: file.StickyCookieName, Value: sticky, Path: "/", HttpOnly: true}).String())
+				}
+				if req.exchange != nil && resp.StatusCode >= http.StatusOK {
+					req.exchange.CaptureResponse(resp)
+				}
+				compressResponse(host, r, resp)
+				lenConn := conn.NewLenConn(c)
+				if err := resp.Write(lenConn); err != nil {
+					logs.Error(err)
+					return
+				}
+				host.Flow.Add(0, int64(lenConn.Len))
+				logAccess(r, host, lk.Host, resp.StatusCode, lenConn.Len, req.start, "")
+				if recorder != nil {
+					if b, ok := recorder.Bytes(); ok {
+						s.cache.Store(r, storeResp, b, req.requestTime)
+					}
+				}
+				//the informational response is followed by the final response of the same request
+				if resp.StatusCode >= http.StatusOK {
+					if req.exchange != nil {
+						inspect.Add(req.exchange, lk.Host)
+					}
+					req = nil
+				}
+			}
+		}(connClient, forwarded, host, lk)
+		return true
+	}
 reset:
-	if isReset {
-		host.Client.AddConn()
+	if connHost != nil {
+		s.ReleaseConn(connHost.Client, &connHost.Limit)
+		connHost = nil
 	}
 	if host, err = file.GetDb().GetInfoByHost(r.Host, r); err != nil {
 		logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
+		writeErrorPage(c, r, nil, http.StatusNotFound, "the host is not found", start)
 		return
 	}
-	if err := s.CheckFlowAndConnNum(host.Client); err != nil {
-		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
+	if !host.AllowRequest(common.GetIpByAddr(r.RemoteAddr)) {
+		writeErrorPage(c, r, host, http.StatusTooManyRequests, "the request rate of the ip exceeds the limit", start)
 		return
 	}
-	if !isReset {
-		defer host.Client.AddConn()
+	if err := s.CheckFlowAndConnNum(host.Client, host.Flow, &host.Limit); err != nil {
+		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
+		if err == errConnExceeded || err == errTaskConnExceeded {
+			writeErrorPage(c, r, host, http.StatusTooManyRequests, err.Error(), start)
+		} else {
+			writeErrorPage(c, r, host, http.StatusServiceUnavailable, err.Error(), start)
+		}
+		return
 	}
-	if err = s.auth(r, c, host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
-		logs.Warn("auth error", err, r.RemoteAddr)
+	connHost = host
+	//redirect to https before the auth, the password is not sent in plain text
+	if host.ForceHttps && r.URL.Scheme == "http" && s.httpsPort > 0 {
+		header := make(http.Header)
+		header.Set("Location", s.httpsUrl(r))
+		header.Set("Connection", "close")
+		n, _ := writeResponse(c, r, http.StatusMovedPermanently, header, "")
+		logs.Trace("%s request, method %s, host %s, url %s, remote address %s, redirect to https", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
+		host.Flow.Add(0, int64(n))
+		logAccess(r, host, "", http.StatusMovedPermanently, n, start, "")
 		return
 	}
-	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
-		logs.Warn(err.Error())
+	if subject, ok := verifyClientCert(c.Conn, host); !ok {
+		writeErrorPage(c, r, host, http.StatusForbidden, "the client certificate is invalid or missing", start)
 		return
+	} else {
+		certSubject = subject
 	}
-	lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy)
-	if target, err = s.bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
-		logs.Notice("connect to target %s error %s", lk.Host, err)
+	if err = s.auth(r, c, host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
+		logs.Warn("auth error", err, r.RemoteAddr)
+		logAccess(r, host, "", http.StatusUnauthorized, len(common.UnauthorizedBytes), start, "")
 		return
 	}
-	connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
-
-	//read from inc-client
-	go func() {
-		wg.Add(1)
-		isReset = false
-		defer connClient.Close()
-		defer func() {
-			wg.Done()
-			if !isReset {
-				c.Close()
-			}
-		}()
-		for {
-			if resp, err := http.ReadResponse(bufio.NewReader(connClient), r); err != nil || resp == nil || r == nil {
-				// if there got broken pipe, http.ReadResponse will get a nil
-				return
-			} else {
-				//if the cache is start and the response is in the extension,store the response to the cache list
-				if s.useCache && r.URL != nil && strings.Contains(r.URL.Path, ".") {
-					b, err := httputil.DumpResponse(resp, true)
-					if err != nil {
-						return
-					}
-					c.Write(b)
-					host.Flow.Add(0, int64(len(b)))
-					s.cache.Add(filepath.Join(host.Host, r.URL.Path), b)
-				} else {
-					lenConn := conn.NewLenConn(c)
-					if err := resp.Write(lenConn); err != nil {
-						logs.Error(err)
-						return
-					}
-					host.Flow.Add(0, int64(lenConn.Len))
-				}
-			}
-		}
-	}()
 
 	for {
-		//if the cache start and the request is in the cache list, return the cache
-		if s.useCache {
-			if v, ok := s.cache.Get(filepath.Join(host.Host, r.URL.Path)); ok {
-				n, err := c.Write(v.([]byte))
+		//match the route rules of the host, redirect and fixed response are returned directly
+		if rule, path := host.MatchRouteRule(r); rule != nil {
+			if rule.Rewrite == "" {
+				n, err := writeRouteResponse(c, r, rule, path)
 				if err != nil {
 					break
 				}
-				logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cache", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
+				logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return route response %d", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String(), rule.Code)
 				host.Flow.Add(0, int64(n))
-				//if return cache and does not create a new conn with client and Connection is not set or close, close the connection.
-				if strings.ToLower(r.Header.Get("Connection")) == "close" || strings.ToLower(r.Header.Get("Connection")) == "" {
+				logAccess(r, host, "", rule.Code, n, start, "")
+				if r.Close || strings.ToLower(r.Header.Get("Connection")) == "close" {
 					break
 				}
 				goto readReq
 			}
+			logs.Trace("rewrite url %s to %s, host %s", r.URL.Path, path, r.Host)
+			if i := strings.Index(path, "?"); i > -1 {
+				path, r.URL.RawQuery = path[:i], path[i+1:]
+			}
+			r.URL.Path = path
+			r.URL.RawPath = ""
+			r.RequestURI = r.URL.RequestURI()
+		}
+
+		//answer the cors preflight request at the edge
+		if host.CorsOrigin != "" && common.IsCorsPreflight(r) {
+			header := make(http.Header)
+			common.SetCorsHeader(header, r, host.CorsOrigin)
+			setHstsHeader(header, r, host)
+			n, err := writeResponse(c, r, http.StatusNoContent, header, "")
+			if err != nil {
+				break
+			}
+			logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cors preflight", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
+			host.Flow.Add(0, int64(n))
+			logAccess(r, host, "", http.StatusNoContent, n, start, "")
+			if r.Close || strings.ToLower(r.Header.Get("Connection")) == "close" {
+				break
+			}
+			goto readReq
+		}
+
+		//if the cache start and the stored response is fresh, return the cache, the stale one is validated by the target
+		validating = nil
+		if s.cache != nil && !host.NoCache {
+			s.cache.Invalidate(r)
+			if e := s.cache.Lookup(r); e != nil {
+				if e.Fresh(r) {
+					resp := e.Response(r)
+					common.SetCorsHeader(resp.Header, r, host.CorsOrigin)
+					setHstsHeader(resp.Header, r, host)
+					compressResponse(host, r, resp)
+					lenConn = conn.NewLenConn(c)
+					if err := resp.Write(lenConn); err != nil {
+						break
+					}
+					logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cache", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
+					host.Flow.Add(0, int64(lenConn.Len))
+					logAccess(r, host, "cache", resp.StatusCode, lenConn.Len, start, "")
+					if r.Close || strings.ToLower(r.Header.Get("Connection")) == "close" {
+						break
+					}
+					goto readReq
+				} else if e.Validatable() && e.AddConditions(r) {
+					validating = e
+				}
+			}
+		}
+		//the target is selected and connected when the first request is forwarded
+		if connClient == nil && !dial() {
+			break
 		}
+		//the request seen by the visitor, the response is handled with it
+		req = &forwardRequest{r: r.Clone(context.Background()), start: start, requestTime: time.Now(), validating: validating}
 
+		//forward the subject of the client certificate, the header sent by the visitor is removed
+		if host.CertHeader != "" {
+			r.Header.Del(host.CertHeader)
+			if certSubject != "" {
+				r.Header.Set(host.CertHeader, certSubject)
+			}
+		}
 		//change the host and header and set proxy setting
 		common.ChangeHostAndHeader(r, host.HostChange, host.HeaderChange, c.Conn.RemoteAddr().String(), s.addOrigin)
 		logs.Trace("%s request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String(), lk.Host)
+		//capture the request for the inspector before written, the response may be read before the request is written completely
+		if inspect.Enabled(host.Inspect) {
+			req.exchange = inspect.Capture(r, host.Id, common.GetIpByAddr(r.RemoteAddr))
+		}
+		//only this loop sends to the queue, it does not block when not full
+		if len(forwarded) == cap(forwarded) {
+			logs.Warn("too many pipelined requests from %s, host %s", c.RemoteAddr().String(), r.Host)
+			break
+		}
+		forwarded <- req
 		//write
 		lenConn = conn.NewLenConn(connClient)
 		if err := r.Write(lenConn); err != nil {
@@ -230,28 +427,202 @@ reset:
 			break
 		}
 		host.Flow.Add(int64(lenConn.Len), 0)
+		if req.exchange != nil {
+			req.exchange.RequestSent()
+		}
 
 	readReq:
 		//read req from connection
 		if r, err = http.ReadRequest(bufio.NewReader(c)); err != nil {
+			//the target closed after the visitor is not a failure of it
+			conn.CancelReport(target)
 			break
 		}
+		start = time.Now()
 		r.URL.Scheme = scheme
+		r.RemoteAddr = c.RemoteAddr().String()
 		//What happened ，Why one character less???
 		r.Method = resetReqMethod(r.Method)
 		if hostTmp, err := file.GetDb().GetInfoByHost(r.Host, r); err != nil {
 			logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
+			writeErrorPage(c, r, nil, http.StatusNotFound, "the host is not found", start)
 			break
 		} else if host != hostTmp {
+			host.Target.ReleaseTarget(targetAddr)
+			targetAddr = ""
 			host = hostTmp
 			isReset = true
-			connClient.Close()
+			if connClient != nil {
+				connClient.Close()
+				connClient = nil
+			}
 			goto reset
+		} else if !host.AllowRequest(common.GetIpByAddr(r.RemoteAddr)) {
+			writeErrorPage(c, r, host, http.StatusTooManyRequests, "the request rate of the ip exceeds the limit", start)
+			break
 		}
 	}
 	wg.Wait()
 }
 
+//write the redirect or the fixed response of the route rule to the connection
+func writeRouteResponse(c io.Writer, r *http.Request, rule *file.RouteRule, target string) (int, error) {
+	header := make(http.Header)
+	if rule.Redirect != "" {
+		if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+			target += "?" + r.URL.RawQuery
+		}
+		header.Set("Location", target)
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return writeResponse(c, r, rule.Code, header, rule.Respond)
+}
+
+//write a response generated by the proxy itself to the connection
+func writeResponse(c io.Writer, r *http.Request, code int, header http.Header, body string) (int, error) {
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       r,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	lenConn := conn.NewLenConn(c)
+	err := resp.Write(lenConn)
+	return lenConn.Len, err
+}
+
+//resend the captured request to the target of the host, the response is captured as a new exchange
+func (s *httpServer) Replay(host *file.Host, e *inspect.Exchange) error {
+	if e.ReqTruncated {
+		return errors.New("the body of the request is truncated")
+	}
+	r, err := http.NewRequest(e.Method, "http://"+e.Host+e.Url, strings.NewReader(e.ReqBody))
+	if err != nil {
+		return err
+	}
+	r.Host = e.Host
+	r.Header = e.ReqHeader.Clone()
+	r.Close = true
+	targetAddr, err := host.Target.GetTarget(e.RemoteIp, getStickyCookie(r))
+	if err != nil {
+		return err
+	}
+	defer host.Target.ReleaseTarget(targetAddr)
+	lk := newHostLink(host, targetAddr, "")
+	target, err := s.sendLinkInfo(host.Client.Id, lk, nil, host.Target)
+	if err != nil {
+		return err
+	}
+	target.SetDeadline(time.Now().Add(replayTimeout))
+	connClient := conn.GetConn(target, lk.Crypt, lk.Compress, host.GetRate(host.Client.Rate), true)
+	defer connClient.Close()
+	exchange := inspect.Capture(r, host.Id, e.RemoteIp)
+	exchange.Replay = true
+	if err := r.Write(connClient); err != nil {
+		return err
+	}
+	exchange.RequestSent()
+	resp, err := http.ReadResponse(bufio.NewReader(connClient), r)
+	if err != nil {
+		return err
+	}
+	exchange.CaptureResponse(resp)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	inspect.Add(exchange, lk.Host)
+	return nil
+}
+
+//the https url of the request, the port is omitted if https_proxy_port is 443
+func (s *httpServer) httpsUrl(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if s.httpsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.httpsPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+//set the HSTS header to the https response of the host
+func setHstsHeader(header http.Header, r *http.Request, host *file.Host) {
+	if host.HstsMaxAge > 0 && r.URL.Scheme == "https" {
+		header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(host.HstsMaxAge))
+	}
+}
+
+//compress the response when the host enables it and the visitor accepts,
+//the flow of the host is counted by the compressed bytes written to the visitor
+func compressResponse(host *file.Host, r *http.Request, resp *http.Response) {
+	if host.Compression == "" {
+		return
+	}
+	if encoding := common.NegotiateEncoding(r.Header.Get("Accept-Encoding"), host.Compression); encoding != "" && common.IsCompressible(r, resp, host.CompressType) {
+		common.CompressResponse(resp, encoding)
+	}
+}
+
+//write the access log of the request, host is nil if it is not found
+func logAccess(r *http.Request, host *file.Host, target string, status, n int, start time.Time, requestId string) {
+	hostLog := host != nil && host.AccessLog
+	if !accesslog.Enabled(hostLog) {
+		return
+	}
+	record := &accesslog.Record{
+		Time:      start,
+		RemoteIp:  common.GetIpByAddr(r.RemoteAddr),
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      r.RequestURI,
+		Proto:     r.Proto,
+		Status:    status,
+		Bytes:     int64(n),
+		Target:    target,
+		Latency:   float64(time.Since(start)) / float64(time.Millisecond),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		RequestId: requestId,
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		record.User = user
+	}
+	if host != nil {
+		record.HostId = host.Id
+		record.ClientId = host.Client.Id
+	}
+	accesslog.Log(record, hostLog)
+}
+
+//get the value of the sticky cookie from the request
+func getStickyCookie(r *http.Request) string {
+	if c, err := r.Cookie(file.StickyCookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+//the link to the target of the host, the tls settings are sent if it is a https target
+func newHostLink(host *file.Host, targetAddr, remoteAddr string) *conn.Link {
+	opts := []conn.Option{conn.LinkProxyProtocol(host.Target.ProxyProtocol)}
+	if _, ok := conn.SplitHttpsTarget(targetAddr); ok {
+		opts = append(opts, conn.LinkTls(&conn.TlsOption{
+			ServerName: host.Target.TlsServerName,
+			SkipVerify: host.Target.TlsSkipVerify,
+			Ca:         host.Target.TlsCa,
+			Cert:       host.Target.TlsCert,
+			Key:        host.Target.TlsKey,
+		}))
+	}
+	return conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, remoteAddr, host.Target.LocalProxy, opts...)
+}
+
 func resetReqMethod(method string) string {
 	if method == "ET" {
 		return "GET"
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
@@ -22,13 +23,10 @@ type HttpsServer struct {
 	httpsListenerMap sync.Map
 }
 
-func NewHttpsServer(l net.Listener, bridge NetBridge, useCache bool, cacheLen int) *HttpsServer {
+func NewHttpsServer(l net.Listener, bridge NetBridge, httpCache *cache.HttpCache) *HttpsServer {
 	https := &HttpsServer{listener: l}
 	https.bridge = bridge
-	https.useCache = useCache
-	if useCache {
-		https.cache = cache.New(cacheLen)
-	}
+	https.cache = httpCache
 	return https
 }
 
@@ -44,8 +42,11 @@ func (https *HttpsServer) Start() error {
 		keyFile := beego.AppConfig.String("https_default_key_file")
 		if common.FileExists(certFile) && common.FileExists(keyFile) {
 			l := NewHttpsListener(https.listener)
-			https.NewHttps(l, certFile, keyFile)
-			https.httpsListenerMap.Store("default", l)
+			if err := https.NewHttps(l, certFile, keyFile); err != nil {
+				logs.Error("load the default certificate error %s", err)
+			} else {
+				https.httpsListenerMap.Store("default", l)
+			}
 		}
 		conn.Accept(https.listener, func(c net.Conn) {
 			serverName, rb := GetServerNameFromClientHello(c)
@@ -63,18 +64,26 @@ func (https *HttpsServer) Start() error {
 					logs.Notice("the url %s can't be parsed!,remote addr %s", serverName, c.RemoteAddr().String())
 					return
 				} else {
-					if !common.FileExists(host.CertFilePath) || !common.FileExists(host.KeyFilePath) {
+					certFile, keyFile := host.CertFilePath, host.KeyFilePath
+					if !common.FileExists(certFile) || !common.FileExists(keyFile) {
+						certFile, keyFile = beego.AppConfig.String("https_default_cert_file"), beego.AppConfig.String("https_default_key_file")
 						//if the host cert file or key file is not set ,use the default file
-						if v, ok := https.httpsListenerMap.Load("default"); ok {
+						if v, ok := https.httpsListenerMap.Load("default"); ok && host.ClientCa == "" {
 							l = v.(*HttpsListener)
-						} else {
+						} else if !common.FileExists(certFile) || !common.FileExists(keyFile) {
 							c.Close()
 							logs.Error("the key %s cert %s file is not exist", host.KeyFilePath, host.CertFilePath)
 							return
 						}
-					} else {
+					}
+					//the host verifying the client certificates uses its own listener even with the default certificate
+					if l == nil {
 						l = NewHttpsListener(https.listener)
-						https.NewHttps(l, host.CertFilePath, host.KeyFilePath)
+						if err := https.NewHttps(l, certFile, keyFile); err != nil {
+							c.Close()
+							logs.Error("load the key %s cert %s file error %s", keyFile, certFile, err)
+							return
+						}
 						https.httpsListenerMap.Store(serverName, l)
 					}
 				}
@@ -92,17 +101,23 @@ func (https *HttpsServer) Close() error {
 	return https.listener.Close()
 }
 
-// new https server by cert and key file
-func (https *HttpsServer) NewHttps(l net.Listener, certFile string, keyFile string) {
+// new https server by cert and key file, the client certificates are verified if the ca of the host is set
+func (https *HttpsServer) NewHttps(l net.Listener, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server := https.NewServer(0, "https")
+	server.TLSConfig = clientAuthConfig(cert)
 	go func() {
-		logs.Error(https.NewServer(0, "https").ServeTLS(l, certFile, keyFile))
+		logs.Error(server.ServeTLS(l, "", ""))
 	}()
+	return nil
 }
 
 //handle the https which is just proxy to other client
 func (https *HttpsServer) handleHttps(c net.Conn) {
 	hostName, rb := GetServerNameFromClientHello(c)
-	var targetAddr string
 	r := buildHttpsRequest(hostName)
 	var host *file.Host
 	var err error
@@ -111,21 +126,20 @@ func (https *HttpsServer) handleHttps(c net.Conn) {
 		logs.Notice("the url %s can't be parsed!", hostName)
 		return
 	}
-	if err := https.CheckFlowAndConnNum(host.Client); err != nil {
+	if err := https.CheckFlowAndConnNum(host.Client, host.Flow, &host.Limit); err != nil {
 		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
 		c.Close()
 		return
 	}
-	defer host.Client.AddConn()
+	defer https.ReleaseConn(host.Client, &host.Limit)
 	if err = https.auth(r, conn.NewConn(c), host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
 		logs.Warn("auth error", err, r.RemoteAddr)
 		return
 	}
-	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
+	logs.Trace("new https connection,clientId %d,host %s,remote address %s", host.Client.Id, r.Host, c.RemoteAddr().String())
+	if err = https.DealTarget(conn.NewConn(c), host.Client, host.Target, &host.Limit, rb, host.Flow); err != nil {
 		logs.Warn(err.Error())
 	}
-	logs.Trace("new https connection,clientId %d,host %s,remote address %s", host.Client.Id, r.Host, c.RemoteAddr().String())
-	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, host.Flow, host.Target.LocalProxy)
 }
 
 type HttpsListener struct {
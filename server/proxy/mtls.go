@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+type clientCaPool struct {
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+//the loaded client ca files, loaded again when the file is modified
+var clientCaPools sync.Map
+
+//load the ca bundle file to verify the client certificates
+func loadClientCa(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := clientCaPools.Load(path); ok && v.(*clientCaPool).modTime.Equal(info.ModTime()) {
+		return v.(*clientCaPool).pool, nil
+	}
+	b, err := common.ReadAllFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	clientCaPools.Store(path, &clientCaPool{pool: pool, modTime: info.ModTime()})
+	return pool, nil
+}
+
+//the verification mode of the client certificates, require by default
+func clientAuthType(mode string) tls.ClientAuthType {
+	if mode == "optional" {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.RequireAndVerifyClientCert
+}
+
+//the tls config of the https listener, the ca of the host is got at every handshake by the server name,
+//so the modified ca file and the edited host are applied to the new connections
+func clientAuthConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName == "" {
+				return nil, nil
+			}
+			host, err := file.GetDb().GetInfoByHost(hello.ServerName, buildHttpsRequest(hello.ServerName))
+			if err != nil || host.ClientCa == "" {
+				return nil, nil
+			}
+			pool, err := loadClientCa(host.ClientCa)
+			if err != nil {
+				//the request is rejected by verifyClientCert later
+				logs.Error("load the client ca %s of host %s error %s", host.ClientCa, host.Host, err)
+				return nil, nil
+			}
+			return &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: clientAuthType(host.ClientAuth)}, nil
+		},
+	}
+}
+
+//verify the client certificate of the connection by the ca of the host and return the subject of it.
+//it is verified again as the host of the request may be different from the server name of the tls handshake
+func verifyClientCert(c net.Conn, host *file.Host) (string, bool) {
+	if host.ClientCa == "" {
+		return "", true
+	}
+	required := clientAuthType(host.ClientAuth) == tls.RequireAndVerifyClientCert
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return "", !required
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", !required
+	}
+	pool, err := loadClientCa(host.ClientCa)
+	if err != nil {
+		logs.Error("load the client ca %s of host %s error %s", host.ClientCa, host.Host, err)
+		return "", false
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return "", false
+	}
+	return certs[0].Subject.String(), true
+}
@@ -1,11 +1,13 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
@@ -39,6 +41,11 @@ const (
 	addrTypeNotSupported
 )
 
+const (
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+)
+
 const (
 	UserPassAuth    = uint8(2)
 	userAuthVersion = uint8(1)
@@ -51,8 +58,8 @@ type Sock5ModeServer struct {
 	listener net.Listener
 }
 
-//req
-func (s *Sock5ModeServer) handleRequest(c net.Conn) {
+//req, user is the account authenticated
+func (s *Sock5ModeServer) handleRequest(c net.Conn, user string) {
 	/*
 		The SOCKS request is formed as follows:
 		+----+-----+-------+------+----------+----------+
@@ -73,11 +80,11 @@ func (s *Sock5ModeServer) handleRequest(c net.Conn) {
 
 	switch header[1] {
 	case connectMethod:
-		s.handleConnect(c)
+		s.handleConnect(c, user)
 	case bindMethod:
-		s.handleBind(c)
+		s.handleBind(c, user)
 	case associateMethod:
-		s.handleUDP(c)
+		s.handleUDP(c, user)
 	default:
 		s.sendReply(c, commandNotSupported)
 		c.Close()
@@ -86,18 +93,29 @@ func (s *Sock5ModeServer) handleRequest(c net.Conn) {
 
 //reply
 func (s *Sock5ModeServer) sendReply(c net.Conn, rep uint8) {
+	s.sendAddrReply(c, rep, c.LocalAddr().String())
+}
+
+//reply with the bound address
+func (s *Sock5ModeServer) sendAddrReply(c net.Conn, rep uint8, addr string) {
 	reply := []byte{
 		5,
 		rep,
 		0,
-		1,
+		ipV4,
 	}
 
-	localAddr := c.LocalAddr().String()
-	localHost, localPort, _ := net.SplitHostPort(localAddr)
-	ipBytes := net.ParseIP(localHost).To4()
-	nPort, _ := strconv.Atoi(localPort)
-	reply = append(reply, ipBytes...)
+	host, port, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	if ip.To4() != nil {
+		reply = append(reply, ip.To4()...)
+	} else if ip != nil {
+		reply[3] = ipV6
+		reply = append(reply, ip.To16()...)
+	} else {
+		reply = append(reply, net.IPv4zero.To4()...)
+	}
+	nPort, _ := strconv.Atoi(port)
 	portBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(portBytes, uint16(nPort))
 	reply = append(reply, portBytes...)
@@ -105,8 +123,8 @@ func (s *Sock5ModeServer) sendReply(c net.Conn, rep uint8) {
 	c.Write(reply)
 }
 
-//do conn
-func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
+//read the destination address of the request
+func (s *Sock5ModeServer) readAddr(c net.Conn) (string, error) {
 	addrType := make([]byte, 1)
 	c.Read(addrType)
 	var host string
@@ -127,33 +145,95 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 		host = string(domain)
 	default:
 		s.sendReply(c, addrTypeNotSupported)
-		return
+		return "", errors.New("address type not supported")
 	}
 
 	var port uint16
 	binary.Read(c, binary.BigEndian, &port)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+//do conn
+func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8, user string) {
 	// connect to host
-	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	addr, err := s.readAddr(c)
+	if err != nil {
+		return
+	}
+	addr, ok := s.allowDest(addr, c)
+	if !ok {
+		s.sendReply(c, notAllowed)
+		c.Close()
+		return
+	}
 	var ltype string
 	if command == associateMethod {
 		ltype = common.CONN_UDP
 	} else {
 		ltype = common.CONN_TCP
 	}
+	flow, release := s.accountFlow(user)
+	defer release()
 	s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, ltype, func() {
 		s.sendReply(c, succeeded)
-	}, s.task.Flow, s.task.Target.LocalProxy)
+	}, flow, s.task.Target.LocalProxy, conn.LinkProxyProtocol(s.task.Target.ProxyProtocol))
 	return
 }
 
 //conn
-func (s *Sock5ModeServer) handleConnect(c net.Conn) {
-	s.doConnect(c, connectMethod)
+func (s *Sock5ModeServer) handleConnect(c net.Conn, user string) {
+	s.doConnect(c, connectMethod, user)
+}
+
+// passive mode, the client listens on the internal side and the inbound connection is relayed back
+func (s *Sock5ModeServer) handleBind(c net.Conn, user string) {
+	addr, err := s.readAddr(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	addr, ok := s.allowDest(addr, c)
+	if !ok {
+		s.sendReply(c, notAllowed)
+		c.Close()
+		return
+	}
+	s.bind(c, addr, user, func(ok bool, bindAddr string) {
+		if ok {
+			s.sendAddrReply(c, succeeded, bindAddr)
+		} else {
+			s.sendReply(c, serverFailure)
+		}
+	})
 }
 
-// passive mode
-func (s *Sock5ModeServer) handleBind(c net.Conn) {
+//bind through the client, reply is called with the address listened by the client first,
+//then with the address of the inbound connection
+func (s *Sock5ModeServer) bind(c net.Conn, addr, user string, reply func(ok bool, bindAddr string)) {
+	link := conn.NewLink("bind", addr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.RemoteAddr().String(), false)
+	target, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
+	if err != nil {
+		logs.Warn("get connection from client id %d  error %s", s.task.Client.Id, err.Error())
+		reply(false, "")
+		c.Close()
+		return
+	}
+	for i := 0; i < 2; i++ {
+		b, err := conn.NewConn(target).GetShortLenContent()
+		if err != nil {
+			logs.Warn("socks bind for %s error %s", addr, err)
+			reply(false, "")
+			target.Close()
+			c.Close()
+			return
+		}
+		reply(true, string(b))
+	}
+	flow, release := s.accountFlow(user)
+	defer release()
+	conn.CopyWaitGroup(target, c, link.Crypt, link.Compress, s.task.GetRate(s.task.Client.Rate), flow, true, nil)
 }
+
 func (s *Sock5ModeServer) sendUdpReply(writeConn net.Conn, c net.Conn, rep uint8, serverIp string) {
 	reply := []byte{
 		5,
@@ -173,7 +253,7 @@ func (s *Sock5ModeServer) sendUdpReply(writeConn net.Conn, c net.Conn, rep uint8
 
 }
 
-func (s *Sock5ModeServer) handleUDP(c net.Conn) {
+func (s *Sock5ModeServer) handleUDP(c net.Conn, user string) {
 	defer c.Close()
 	addrType := make([]byte, 1)
 	c.Read(addrType)
@@ -200,7 +280,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	//读取端口
 	var port uint16
 	binary.Read(c, binary.BigEndian, &port)
-	logs.Warn(host, string(port))
+	logs.Warn(host, strconv.Itoa(int(port)))
 	replyAddr, err := net.ResolveUDPAddr("udp", s.task.ServerIp+":0")
 	if err != nil {
 		logs.Error("build local reply addr error", err)
@@ -222,6 +302,8 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 		logs.Warn("get connection from client id %d  error %s", s.task.Client.Id, err.Error())
 		return
 	}
+	flow, release := s.accountFlow(user)
+	defer release()
 
 	var clientAddr net.Addr
 	// copy buffer
@@ -239,10 +321,34 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 			if clientAddr == nil {
 				clientAddr = laddr
 			}
-			if _, err := target.Write(b[:n]); err != nil {
+			//the datagram to the destination denied by the acl is dropped
+			var dest string
+			var ok bool
+			d, err := common.ReadUDPDatagram(bytes.NewReader(b[:n]))
+			if err == nil {
+				dest, ok = s.task.AllowDest(d.Header.Addr.String())
+			}
+			if !ok {
+				logs.Trace("client id %d, task id %d, drop the udp datagram denied by the acl, remote address %s", s.task.Client.Id, s.task.Id, laddr)
+				continue
+			}
+			data := b[:n]
+			//the domain resolved by the acl is replaced by the checked ip
+			if dest != d.Header.Addr.String() {
+				host, _, _ := net.SplitHostPort(dest)
+				d.Header.Addr = &common.Addr{Type: ipV6, Host: host, Port: d.Header.Addr.Port}
+				if net.ParseIP(host).To4() != nil {
+					d.Header.Addr.Type = ipV4
+				}
+				buf := new(bytes.Buffer)
+				d.Write(buf)
+				data = buf.Bytes()
+			}
+			if _, err := target.Write(data); err != nil {
 				logs.Error("write data to client error", err.Error())
 				return
 			}
+			flow.Add(int64(n), 0)
 		}
 	}()
 
@@ -265,6 +371,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Warn("write data to user ", err.Error())
 				return
 			}
+			flow.Add(0, int64(l))
 		}
 	}()
 
@@ -280,6 +387,109 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	}
 }
 
+//socks4 and socks4a, the version and the command have been read
+func (s *Sock5ModeServer) handleSocks4(c net.Conn, command uint8) {
+	/*
+		The SOCKS4 request is formed as follows:
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+		| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+		| 1  | 1  |    2    |         4         | Variable     | 1  |
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+	*/
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(c, header); err != nil {
+		logs.Warn("illegal socks4 request", err)
+		c.Close()
+		return
+	}
+	userId, err := readNullString(c)
+	if err != nil {
+		logs.Warn("illegal socks4 request", err)
+		c.Close()
+		return
+	}
+	ip := net.IP(header[2:6])
+	host := ip.String()
+	//socks4a, the domain follows the user id if the ip is 0.0.0.x
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNullString(c); err != nil {
+			logs.Warn("illegal socks4a request", err)
+			c.Close()
+			return
+		}
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(header[:2]))))
+	//socks4 has no password, the user id is username:password if the auth is required
+	var user string
+	if s.needAuth() {
+		pair := strings.SplitN(userId, ":", 2)
+		if len(pair) != 2 || !s.checkAccount(pair[0], pair[1]) {
+			logs.Warn("socks4 validation failed, remote address %s", c.RemoteAddr())
+			s.sendSocks4Reply(c, false, "")
+			c.Close()
+			return
+		}
+		user = pair[0]
+	}
+	addr, ok := s.allowDest(addr, c)
+	if !ok {
+		s.sendSocks4Reply(c, false, "")
+		c.Close()
+		return
+	}
+	switch command {
+	case connectMethod:
+		flow, release := s.accountFlow(user)
+		defer release()
+		s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, common.CONN_TCP, func() {
+			s.sendSocks4Reply(c, true, "")
+		}, flow, s.task.Target.LocalProxy, conn.LinkProxyProtocol(s.task.Target.ProxyProtocol))
+	case bindMethod:
+		s.bind(c, addr, user, func(ok bool, bindAddr string) {
+			s.sendSocks4Reply(c, ok, bindAddr)
+		})
+	default:
+		s.sendSocks4Reply(c, false, "")
+		c.Close()
+	}
+}
+
+//reply of socks4, the address is only used by bind
+func (s *Sock5ModeServer) sendSocks4Reply(c net.Conn, ok bool, addr string) {
+	reply := make([]byte, 8)
+	reply[1] = socks4Rejected
+	if ok {
+		reply[1] = socks4Granted
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		nPort, _ := strconv.Atoi(port)
+		binary.BigEndian.PutUint16(reply[2:4], uint16(nPort))
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			copy(reply[4:], ip)
+		}
+	}
+	c.Write(reply)
+}
+
+//read the string ended with null of socks4
+func readNullString(c net.Conn) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= 255 {
+			return "", errors.New("the string is too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
 //new conn
 func (s *Sock5ModeServer) handleConn(c net.Conn) {
 	buf := make([]byte, 2)
@@ -289,9 +499,16 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		return
 	}
 
-	if version := buf[0]; version != 5 {
-		logs.Warn("only support socks5, request from: ", c.RemoteAddr())
-		c.Close()
+	switch buf[0] {
+	case 5:
+	case 4:
+		s.handleSocks4(c, buf[1])
+		return
+	default:
+		//not socks, serve it as a http proxy request with the bytes read
+		hc := conn.NewConn(c)
+		hc.Rb = buf
+		s.dealHttpProxy(hc)
 		return
 	}
 	nMethods := buf[1]
@@ -302,10 +519,12 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		c.Close()
 		return
 	}
-	if (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") || (s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0) {
+	var user string
+	if s.needAuth() {
 		buf[1] = UserPassAuth
 		c.Write(buf)
-		if err := s.Auth(c); err != nil {
+		var err error
+		if user, err = s.Auth(c); err != nil {
 			c.Close()
 			logs.Warn("Validation failed:", err)
 			return
@@ -314,70 +533,68 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		buf[1] = 0
 		c.Write(buf)
 	}
-	s.handleRequest(c)
+	s.handleRequest(c, user)
 }
 
-//socks5 auth
-func (s *Sock5ModeServer) Auth(c net.Conn) error {
+//socks5 auth, return the username authenticated
+func (s *Sock5ModeServer) Auth(c net.Conn) (string, error) {
 	header := []byte{0, 0}
 	if _, err := io.ReadAtLeast(c, header, 2); err != nil {
-		return err
+		return "", err
 	}
 	if header[0] != userAuthVersion {
-		return errors.New("验证方式不被支持")
+		return "", errors.New("验证方式不被支持")
 	}
 	userLen := int(header[1])
 	user := make([]byte, userLen)
 	if _, err := io.ReadAtLeast(c, user, userLen); err != nil {
-		return err
+		return "", err
 	}
 	if _, err := c.Read(header[:1]); err != nil {
-		return errors.New("密码长度获取错误")
+		return "", errors.New("密码长度获取错误")
 	}
 	passLen := int(header[0])
 	pass := make([]byte, passLen)
 	if _, err := io.ReadAtLeast(c, pass, passLen); err != nil {
-		return err
-	}
-
-	var U, P string
-	if s.task.MultiAccount != nil {
-		// enable multi user auth
-		U = string(user)
-		var ok bool
-		P, ok = s.task.MultiAccount.AccountMap[U]
-		if !ok {
-			return errors.New("验证不通过")
-		}
-	} else {
-		U = s.task.Client.Cnf.U
-		P = s.task.Client.Cnf.P
+		return "", err
 	}
 
-	if string(user) == U && string(pass) == P {
+	if s.checkAccount(string(user), string(pass)) {
 		if _, err := c.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return err
+			return "", err
 		}
-		return nil
+		return string(user), nil
 	} else {
 		if _, err := c.Write([]byte{userAuthVersion, authFailure}); err != nil {
-			return err
+			return "", err
 		}
-		return errors.New("验证不通过")
+		return "", errors.New("验证不通过")
 	}
 }
 
 //start
 func (s *Sock5ModeServer) Start() error {
 	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
-		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		ip := common.GetIpByAddr(c.RemoteAddr().String())
+		if !s.task.AllowVisitor(ip) {
+			logs.Info("client id %d, task id %d, the visitor ip %s is rejected by the visitor lists, when socks5 connection", s.task.Client.Id, s.task.Id, ip)
+			c.Close()
+			return
+		}
+		if !s.task.GetIpConn(ip) {
+			logs.Warn("client id %d, task id %d, the connections of ip %s exceed the limit, when socks5 connection", s.task.Client.Id, s.task.Id, ip)
+			c.Close()
+			return
+		}
+		defer s.task.ReleaseIpConn(ip)
+		if err := s.CheckFlowAndConnNum(s.task.Client, s.task.Flow, &s.task.Limit); err != nil {
 			logs.Warn("client id %d, task id %d, error %s, when socks5 connection", s.task.Client.Id, s.task.Id, err.Error())
 			c.Close()
 			return
 		}
 		logs.Trace("New socks5 connection,client %d,remote address %s", s.task.Client.Id, c.RemoteAddr())
 		s.handleConn(c)
-		s.task.Client.AddConn()
+		s.ReleaseConn(s.task.Client, &s.task.Limit)
 	}, &s.listener)
 }
 
@@ -34,14 +34,26 @@ func NewTunnelModeServer(process process, bridge NetBridge, task *file.Tunnel) *
 //开始
 func (s *TunnelModeServer) Start() error {
 	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
-		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		ip := common.GetIpByAddr(c.RemoteAddr().String())
+		if !s.task.AllowVisitor(ip) {
+			logs.Info("client id %d, task id %d, the visitor ip %s is rejected by the visitor lists, when tcp connection", s.task.Client.Id, s.task.Id, ip)
+			c.Close()
+			return
+		}
+		if !s.task.GetIpConn(ip) {
+			logs.Warn("client id %d, task id %d, the connections of ip %s exceed the limit, when tcp connection", s.task.Client.Id, s.task.Id, ip)
+			c.Close()
+			return
+		}
+		defer s.task.ReleaseIpConn(ip)
+		if err := s.CheckFlowAndConnNum(s.task.Client, s.task.Flow, &s.task.Limit); err != nil {
 			logs.Warn("client id %d, task id %d,error %s, when tcp connection", s.task.Client.Id, s.task.Id, err.Error())
 			c.Close()
 			return
 		}
 		logs.Trace("new tcp connection,local port %d,client %d,remote address %s", s.task.Port, s.task.Client.Id, c.RemoteAddr())
 		s.process(conn.NewConn(c), s)
-		s.task.Client.AddConn()
+		s.ReleaseConn(s.task.Client, &s.task.Limit)
 	}, &s.listener)
 }
 
@@ -97,29 +109,14 @@ type process func(c *conn.Conn, s *TunnelModeServer) error
 
 //tcp proxy
 func ProcessTunnel(c *conn.Conn, s *TunnelModeServer) error {
-	targetAddr, err := s.task.Target.GetRandomTarget()
+	err := s.DealTarget(c, s.task.Client, s.task.Target, &s.task.Limit, nil, s.task.Flow)
 	if err != nil {
-		c.Close()
 		logs.Warn("tcp port %d ,client id %d,task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
-		return err
 	}
-	return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy)
+	return err
 }
 
 //http proxy
 func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
-	_, addr, rb, err, r := c.GetHost()
-	if err != nil {
-		c.Close()
-		logs.Info(err)
-		return err
-	}
-	if r.Method == "CONNECT" {
-		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
-		rb = nil
-	}
-	if err := s.auth(r, c, s.task.Client.Cnf.U, s.task.Client.Cnf.P); err != nil {
-		return err
-	}
-	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy)
+	return s.dealHttpProxy(c)
 }
@@ -15,7 +15,7 @@ func HandleTrans(c *conn.Conn, s *TunnelModeServer) error {
 	if addr, err := getAddress(c.Conn); err != nil {
 		return err
 	} else {
-		return s.DealClient(c, s.task.Client, addr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy)
+		return s.DealClient(c, s.task.Client, addr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, conn.LinkProxyProtocol(s.task.Target.ProxyProtocol))
 	}
 }
 
@@ -5,6 +5,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"ehang.io/nps/bridge"
@@ -52,44 +53,109 @@ func (s *UdpModeServer) Start() error {
 	return nil
 }
 
+//a session of the visitor address, the packets are sent to the target through the connection
+type udpSession struct {
+	ready  chan struct{}      //closed when the connection is established
+	conn   io.ReadWriteCloser //nil if the connection fails
+	active int64              //unix nano of the last packet
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.active)))
+}
+
 func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
-	if v, ok := s.addrMap.Load(addr.String()); ok {
-		clientConn, ok := v.(io.ReadWriteCloser)
-		if ok {
-			clientConn.Write(data)
-			s.task.Flow.Add(int64(len(data)), 0)
-		}
-	} else {
-		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
-			logs.Warn("client id %d, task id %d,error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
+	key := addr.String()
+	sess := &udpSession{ready: make(chan struct{})}
+	sess.touch()
+	if v, loaded := s.addrMap.LoadOrStore(key, sess); loaded {
+		s.write(v.(*udpSession), data)
+		return
+	}
+	//only the owner of the session removes it, the packets of the address after that create a new one
+	defer s.addrMap.Delete(key)
+	if err := s.CheckFlowAndConnNum(s.task.Client, s.task.Flow, &s.task.Limit); err != nil {
+		close(sess.ready)
+		logs.Warn("client id %d, task id %d,error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
+		return
+	}
+	defer s.ReleaseConn(s.task.Client, &s.task.Limit)
+	if !s.task.GetUdpSess() {
+		close(sess.ready)
+		logs.Warn("client id %d, task id %d, the udp sessions reach the limit %d, remote address %s", s.task.Client.Id, s.task.Id, s.task.UdpMaxSess, key)
+		return
+	}
+	defer s.task.ReleaseUdpSess()
+	targetAddr, err := s.task.Target.GetTarget(addr.IP.String(), "")
+	if err != nil {
+		close(sess.ready)
+		logs.Warn("client id %d, task id %d, error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
+		return
+	}
+	defer s.task.Target.ReleaseTarget(targetAddr)
+	link := conn.NewLink(common.CONN_UDP, targetAddr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, key, s.task.Target.LocalProxy)
+	clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
+	if err != nil {
+		close(sess.ready)
+		return
+	}
+	target := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, s.task.GetRate(s.task.Client.Rate), true)
+	defer target.Close()
+	sess.conn = target
+	close(sess.ready)
+	s.write(sess, data)
+	done := make(chan struct{})
+	defer close(done)
+	go s.closeIdle(sess, done)
+
+	buf := common.BufPoolUdp.Get().([]byte)
+	defer common.BufPoolUdp.Put(buf)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			logs.Trace("udp session of %s to %s closed, %s", key, targetAddr, err.Error())
 			return
 		}
-		defer s.task.Client.AddConn()
-		link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy)
-		if clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task); err != nil {
-			return
-		} else {
-			target := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true)
-			s.addrMap.Store(addr.String(), target)
-			defer target.Close()
-
-			target.Write(data)
+		sess.touch()
+		s.listener.WriteTo(buf[:n], addr)
+		s.task.Flow.Add(0, int64(n))
+	}
+}
 
-			buf := common.BufPoolUdp.Get().([]byte)
-			defer common.BufPoolUdp.Put(buf)
+//send the packet of the visitor to the target, the session is closed if failed
+func (s *UdpModeServer) write(sess *udpSession, data []byte) {
+	<-sess.ready
+	if sess.conn == nil {
+		return
+	}
+	if _, err := sess.conn.Write(data); err != nil {
+		sess.conn.Close()
+		return
+	}
+	sess.touch()
+	s.task.Flow.Add(int64(len(data)), 0)
+}
 
-			s.task.Flow.Add(int64(len(data)), 0)
-			for {
-				clientConn.SetReadDeadline(time.Now().Add(time.Minute * 10))
-				if n, err := target.Read(buf); err != nil {
-					s.addrMap.Delete(addr.String())
-					logs.Warn(err)
-					return
-				} else {
-					s.listener.WriteTo(buf[:n], addr)
-					s.task.Flow.Add(0, int64(n))
-				}
+//close the session if no packet is sent or received within the timeout of the tunnel
+func (s *UdpModeServer) closeIdle(sess *udpSession, done chan struct{}) {
+	timeout := s.task.GetUdpTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			if idle := sess.idle(); idle < timeout {
+				timer.Reset(timeout - idle)
+				continue
 			}
+			sess.conn.Close()
+			return
 		}
 	}
 }
@@ -5,14 +5,18 @@ import (
 	"errors"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/accesslog"
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/inspect"
 	"ehang.io/nps/server/proxy"
 	"ehang.io/nps/server/tool"
 	"github.com/astaxie/beego"
@@ -71,7 +75,7 @@ func DealBridgeTask() {
 			logs.Trace("New secret connection, addr", s.Conn.Conn.RemoteAddr())
 			if t := file.GetDb().GetTaskByMd5Password(s.Password); t != nil {
 				if t.Status {
-					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy)
+					go dealSecret(s, t)
 				} else {
 					s.Conn.Close()
 					logs.Trace("This key %s cannot be processed,status is close", s.Password)
@@ -84,6 +88,32 @@ func DealBridgeTask() {
 	}
 }
 
+//deal the secret connection within the limits of the client and the tunnel
+func dealSecret(s *conn.Secret, t *file.Tunnel) {
+	base := proxy.NewBaseServer(Bridge, t)
+	if err := base.CheckFlowAndConnNum(t.Client, t.Flow, &t.Limit); err != nil {
+		logs.Warn("client id %d, task id %d, error %s, when secret connection", t.Client.Id, t.Id, err.Error())
+		s.Conn.Close()
+		return
+	}
+	defer base.ReleaseConn(t.Client, &t.Limit)
+	base.DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy, conn.LinkProxyProtocol(t.Target.ProxyProtocol))
+}
+
+//init the access log of the host proxy, the log file is in the same directory of the nps log by default
+func initAccessLog() {
+	logPath := beego.AppConfig.String("log_path")
+	if logPath == "" {
+		logPath = common.GetLogPath()
+	}
+	path := beego.AppConfig.DefaultString("access_log_path", filepath.Join(filepath.Dir(logPath), "nps_access.log"))
+	accesslog.Init(path, beego.AppConfig.DefaultString("access_log_format", accesslog.FormatCombined),
+		beego.AppConfig.DefaultBool("access_log", false),
+		int64(beego.AppConfig.DefaultInt("access_log_max_size", 100))<<20,
+		beego.AppConfig.DefaultInt("access_log_max_backups", 5),
+		beego.AppConfig.DefaultInt("access_log_web_size", 100))
+}
+
 //start a new server
 func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeDisconnect int) {
 	Bridge = bridge.NewTunnel(bridgePort, bridgeType, common.GetBoolByStr(beego.AppConfig.String("ip_limit")), RunList, bridgeDisconnect)
@@ -98,6 +128,15 @@ func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeD
 		go proxy.NewP2PServer(p + 1).Start()
 		go proxy.NewP2PServer(p + 2).Start()
 	}
+	file.SetOutlierDetection(beego.AppConfig.DefaultInt("outlier_max_fail", 5), time.Duration(beego.AppConfig.DefaultInt("outlier_eject_time", 30))*time.Second)
+	initAccessLog()
+	inspect.Init(beego.AppConfig.DefaultInt("inspect_size", 50), beego.AppConfig.DefaultInt("inspect_body_size", 64)<<10)
+	if err := file.SetVisitorFilter(beego.AppConfig.String("geoip_db"), beego.AppConfig.String("visitor_allow"), beego.AppConfig.String("visitor_deny")); err != nil {
+		logs.Error("set the visitor lists error", err)
+	}
+	file.SetGlobalLimit(beego.AppConfig.DefaultInt("global_rate_limit", 0), beego.AppConfig.DefaultInt64("global_flow_limit", 0),
+		beego.AppConfig.DefaultInt("global_flow_reset_day", 1), beego.AppConfig.DefaultString("global_flow_exceed", file.GlobalExceedReject),
+		beego.AppConfig.DefaultInt("global_throttle_rate", 0))
 	go DealBridgeTask()
 	go dealClientFlow()
 	if svr := NewMode(Bridge, cnf); svr != nil {
@@ -118,6 +157,7 @@ func dealClientFlow() {
 		select {
 		case <-ticker.C:
 			dealClientData()
+			file.GetDb().JsonDb.StoreGlobalToJsonFile()
 		}
 	}
 }
@@ -150,12 +190,47 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 		httpsPort, _ := beego.AppConfig.Int("https_proxy_port")
 		useCache, _ := beego.AppConfig.Bool("http_cache")
 		cacheLen, _ := beego.AppConfig.Int("http_cache_length")
+		cacheSize := beego.AppConfig.DefaultInt("http_cache_size", 64)
 		addOrigin, _ := beego.AppConfig.Bool("http_add_origin_header")
-		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, useCache, cacheLen, addOrigin)
+		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, useCache, cacheLen, int64(cacheSize)<<20, addOrigin)
 	}
 	return service
 }
 
+//purge the http cache of the host whose path begins with the path, empty host means all hosts
+func PurgeHttpCache(host, path string) (num int) {
+	RunList.Range(func(key, value interface{}) bool {
+		if svr, ok := value.(interface{ PurgeCache(host, path string) int }); ok {
+			num += svr.PurgeCache(host, path)
+		}
+		return true
+	})
+	return
+}
+
+//resend the captured request of the host to its target
+func ReplayHttpRequest(hostId int, id int64) (err error) {
+	var h *file.Host
+	if h, err = file.GetDb().GetHostById(hostId); err != nil {
+		return
+	}
+	e := inspect.Get(hostId, id)
+	if e == nil {
+		return errors.New("the request is not found")
+	}
+	err = errors.New("the http proxy is not running")
+	RunList.Range(func(key, value interface{}) bool {
+		if svr, ok := value.(interface {
+			Replay(host *file.Host, e *inspect.Exchange) error
+		}); ok {
+			err = svr.Replay(h, e)
+			return false
+		}
+		return true
+	})
+	return
+}
+
 //stop server
 func StopServer(id int) error {
 	//if v, ok := RunList[id]; ok {
@@ -372,6 +447,8 @@ func GetDashboardData() map[string]interface{} {
 	data["clientOnlineCount"] = c
 	data["inletFlowCount"] = int(in)
 	data["exportFlowCount"] = int(out)
+	data["visitorReject"] = file.GetVisitorReject()
+	data["globalFlow"], data["globalFlowLimit"], data["globalRate"], data["globalRateLimit"], data["globalExceeded"] = file.GetGlobal().Stat()
 	var tcp, udp, secret, socks5, p2p, http int
 	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		switch value.(*file.Tunnel).Mode {
@@ -0,0 +1,89 @@
+package tool
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+)
+
+var (
+	autoPorts []int
+	reserved  = make(map[int]bool) //the ports allocated but not used by a tunnel yet
+	portLock  sync.Mutex
+)
+
+func initAutoPort() {
+	autoPorts = common.GetPorts(beego.AppConfig.String("auto_ports"))
+	if len(autoPorts) == 0 {
+		autoPorts = ports
+	}
+}
+
+//allocate a free server port for the tunnel of the mode. the prefer port is used if it is still free,
+//then the ports in auto_ports or allow_ports, the system chooses one if neither is set.
+//the port is reserved until ReleasePort is called after the tunnel is added
+func GetFreePort(mode string, prefer int) (p int, err error) {
+	portLock.Lock()
+	defer portLock.Unlock()
+	defer func() {
+		if err == nil {
+			reserved[p] = true
+		}
+	}()
+	used := make(map[int]bool)
+	for p := range reserved {
+		used[p] = true
+	}
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		used[value.(*file.Tunnel).Port] = true
+		return true
+	})
+	free := func(p int) bool {
+		return p > 0 && !used[p] && TestServerPort(p, mode)
+	}
+	if free(prefer) {
+		return prefer, nil
+	}
+	if len(autoPorts) > 0 {
+		for _, p := range autoPorts {
+			if free(p) {
+				return p, nil
+			}
+		}
+		return 0, errors.New("no free port is left in the auto ports")
+	}
+	//the port chosen by the system may be used by a stopped tunnel, try again
+	for i := 0; i < 10; i++ {
+		var p int
+		if mode == "udp" {
+			l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0")})
+			if err != nil {
+				return 0, err
+			}
+			p = l.LocalAddr().(*net.UDPAddr).Port
+			l.Close()
+		} else {
+			l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0")})
+			if err != nil {
+				return 0, err
+			}
+			p = l.Addr().(*net.TCPAddr).Port
+			l.Close()
+		}
+		if !used[p] {
+			return p, nil
+		}
+	}
+	return 0, errors.New("no free port is found")
+}
+
+//release the reserved port, it is used by the tunnel or not needed any more
+func ReleasePort(p int) {
+	portLock.Lock()
+	defer portLock.Unlock()
+	delete(reserved, p)
+}
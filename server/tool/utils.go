@@ -28,6 +28,7 @@ func StartSystemInfo() {
 func InitAllowPort() {
 	p := beego.AppConfig.String("allow_ports")
 	ports = common.GetPorts(p)
+	initAutoPort()
 }
 
 func TestServerPort(p int, m string) (b bool) {
@@ -125,6 +125,17 @@ func (s *BaseController) AjaxOk(str string) {
 	s.StopRun()
 }
 
+//ajax正确返回，并附带数据
+func (s *BaseController) AjaxOkWithData(str string, data map[string]interface{}) {
+	json := ajax(str, 1)
+	for k, v := range data {
+		json[k] = v
+	}
+	s.Data["json"] = json
+	s.ServeJSON()
+	s.StopRun()
+}
+
 //ajax错误返回
 func (s *BaseController) AjaxErr(str string) {
 	s.Data["json"] = ajax(str, 0)
@@ -3,7 +3,6 @@ package controllers
 import (
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
-	"ehang.io/nps/lib/rate"
 	"ehang.io/nps/server"
 	"github.com/astaxie/beego"
 )
@@ -56,6 +55,9 @@ func (s *ClientController) Add() {
 			},
 			ConfigConnAllow: s.GetBoolNoErr("config_conn_allow"),
 			RateLimit:       s.GetIntNoErr("rate_limit"),
+			InRateLimit:     s.GetIntNoErr("in_rate_limit"),
+			OutRateLimit:    s.GetIntNoErr("out_rate_limit"),
+			RateBurst:       s.GetIntNoErr("rate_burst"),
 			MaxConn:         s.GetIntNoErr("max_conn"),
 			WebUserName:     s.getEscapeString("web_username"),
 			WebPassword:     s.getEscapeString("web_password"),
@@ -119,6 +121,9 @@ func (s *ClientController) Edit() {
 				c.VerifyKey = s.getEscapeString("vkey")
 				c.Flow.FlowLimit = int64(s.GetIntNoErr("flow_limit"))
 				c.RateLimit = s.GetIntNoErr("rate_limit")
+				c.InRateLimit = s.GetIntNoErr("in_rate_limit")
+				c.OutRateLimit = s.GetIntNoErr("out_rate_limit")
+				c.RateBurst = s.GetIntNoErr("rate_burst")
 				c.MaxConn = s.GetIntNoErr("max_conn")
 				c.MaxTunnelNum = s.GetIntNoErr("max_tunnel")
 			}
@@ -133,16 +138,7 @@ func (s *ClientController) Edit() {
 			}
 			c.WebPassword = s.getEscapeString("web_password")
 			c.ConfigConnAllow = s.GetBoolNoErr("config_conn_allow")
-			if c.Rate != nil {
-				c.Rate.Stop()
-			}
-			if c.RateLimit > 0 {
-				c.Rate = rate.NewRate(int64(c.RateLimit * 1024))
-				c.Rate.Start()
-			} else {
-				c.Rate = rate.NewRate(int64(2 << 23))
-				c.Rate.Start()
-			}
+			c.SetRate()
 			file.GetDb().JsonDb.StoreClientsToJsonFile()
 		}
 		s.AjaxOk("save success")
@@ -1,7 +1,12 @@
 package controllers
 
 import (
+	"html/template"
+
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/inspect"
 	"ehang.io/nps/server"
 	"ehang.io/nps/server/tool"
 
@@ -93,22 +98,42 @@ func (s *IndexController) Add() {
 		s.display()
 	} else {
 		t := &file.Tunnel{
-			Port:      s.GetIntNoErr("port"),
-			ServerIp:  s.getEscapeString("server_ip"),
-			Mode:      s.getEscapeString("type"),
-			Target:    &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
-			Id:        int(file.GetDb().JsonDb.GetTaskId()),
-			Status:    true,
-			Remark:    s.getEscapeString("remark"),
-			Password:  s.getEscapeString("password"),
-			LocalPath: s.getEscapeString("local_path"),
-			StripPre:  s.getEscapeString("strip_pre"),
-			Flow:      &file.Flow{},
+			Port:        s.GetIntNoErr("port"),
+			ServerIp:    s.getEscapeString("server_ip"),
+			Mode:        s.getEscapeString("type"),
+			Target:      &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy"), Strategy: s.getEscapeString("lb_strategy"), ProxyProtocol: s.GetIntNoErr("proxy_protocol")},
+			Id:          int(file.GetDb().JsonDb.GetTaskId()),
+			Status:      true,
+			Remark:      s.getEscapeString("remark"),
+			Password:    s.getEscapeString("password"),
+			LocalPath:   s.getEscapeString("local_path"),
+			StripPre:    s.getEscapeString("strip_pre"),
+			Flow:        &file.Flow{FlowLimit: int64(s.GetIntNoErr("flow_limit"))},
+			Limit:       file.Limit{RateLimit: s.GetIntNoErr("rate_limit"), InRateLimit: s.GetIntNoErr("in_rate_limit"), OutRateLimit: s.GetIntNoErr("out_rate_limit"), RateBurst: s.GetIntNoErr("rate_burst"), MaxConn: s.GetIntNoErr("max_conn")},
+			IpConnLimit: s.GetIntNoErr("ip_conn_limit"),
+			DestAcl:     s.GetString("dest_acl"),
+			UdpTimeout:  s.GetIntNoErr("udp_timeout"),
+			UdpMaxSess:  s.GetIntNoErr("udp_max_sess"),
 		}
-		if !tool.TestServerPort(t.Port, t.Mode) {
-			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
+		t.VisitorAllow, t.VisitorDeny = s.GetString("visitor_allow"), s.GetString("visitor_deny")
+		if accounts := file.ParseAccounts(s.GetString("multi_account")); len(accounts) > 0 {
+			t.MultiAccount = &file.MultiAccount{AccountMap: accounts}
+		}
+		if _, err := file.ParseAclRules(t.DestAcl); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if _, err := file.NewVisitorFilter(t.VisitorAllow, t.VisitorDeny); err != nil {
+			s.AjaxErr(err.Error())
 		}
 		var err error
+		if common.IsAutoPort(s.getEscapeString("port")) && t.Mode != "secret" && t.Mode != "p2p" {
+			if t.Port, err = tool.GetFreePort(t.Mode, 0); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			defer tool.ReleasePort(t.Port)
+		} else if !tool.TestServerPort(t.Port, t.Mode) {
+			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
+		}
 		if t.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 			s.AjaxErr(err.Error())
 		}
@@ -121,7 +146,7 @@ func (s *IndexController) Add() {
 		if err := server.AddTask(t); err != nil {
 			s.AjaxErr(err.Error())
 		} else {
-			s.AjaxOk("add success")
+			s.AjaxOkWithData("add success", map[string]interface{}{"id": t.Id, "port": t.Port})
 		}
 	}
 }
@@ -151,13 +176,31 @@ func (s *IndexController) Edit() {
 		if t, err := file.GetDb().GetTask(id); err != nil {
 			s.error()
 		} else {
+			if _, err := file.ParseAclRules(s.GetString("dest_acl")); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if _, err := file.NewVisitorFilter(s.GetString("visitor_allow"), s.GetString("visitor_deny")); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
 			if client, err := file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 				return
 			} else {
 				t.Client = client
 			}
-			if s.GetIntNoErr("port") != t.Port {
+			//the current port is kept if the mode is not changed
+			mode := s.getEscapeString("type")
+			if common.IsAutoPort(s.getEscapeString("port")) && mode != "secret" && mode != "p2p" {
+				if t.Port <= 0 || mode != t.Mode {
+					if t.Port, err = tool.GetFreePort(mode, 0); err != nil {
+						s.AjaxErr(err.Error())
+						return
+					}
+					defer tool.ReleasePort(t.Port)
+				}
+			} else if s.GetIntNoErr("port") != t.Port {
 				if !tool.TestServerPort(s.GetIntNoErr("port"), t.Mode) {
 					s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 					return
@@ -166,18 +209,38 @@ func (s *IndexController) Edit() {
 			}
 			t.ServerIp = s.getEscapeString("server_ip")
 			t.Mode = s.getEscapeString("type")
-			t.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			t.Target = &file.Target{TargetStr: s.getEscapeString("target"), Strategy: s.getEscapeString("lb_strategy"), ProxyProtocol: s.GetIntNoErr("proxy_protocol")}
 			t.Password = s.getEscapeString("password")
 			t.Id = id
 			t.LocalPath = s.getEscapeString("local_path")
 			t.StripPre = s.getEscapeString("strip_pre")
 			t.Remark = s.getEscapeString("remark")
+			t.IpConnLimit = s.GetIntNoErr("ip_conn_limit")
+			t.Flow.FlowLimit = int64(s.GetIntNoErr("flow_limit"))
+			t.RateLimit = s.GetIntNoErr("rate_limit")
+			t.InRateLimit = s.GetIntNoErr("in_rate_limit")
+			t.OutRateLimit = s.GetIntNoErr("out_rate_limit")
+			t.RateBurst = s.GetIntNoErr("rate_burst")
+			t.MaxConn = s.GetIntNoErr("max_conn")
+			t.DestAcl = s.GetString("dest_acl")
+			t.VisitorAllow = s.GetString("visitor_allow")
+			t.VisitorDeny = s.GetString("visitor_deny")
+			t.UdpTimeout = s.GetIntNoErr("udp_timeout")
+			t.UdpMaxSess = s.GetIntNoErr("udp_max_sess")
+			//the stats of the accounts are kept when the accounts are modified
+			if accounts := file.ParseAccounts(s.GetString("multi_account")); len(accounts) == 0 {
+				t.MultiAccount = nil
+			} else if t.MultiAccount == nil {
+				t.MultiAccount = &file.MultiAccount{AccountMap: accounts}
+			} else {
+				t.MultiAccount.SetAccounts(accounts)
+			}
 			t.Target.LocalProxy = s.GetBoolNoErr("local_proxy")
 			file.GetDb().UpdateTask(t)
 			server.StopServer(t.Id)
 			server.StartTask(t.Id)
+			s.AjaxOkWithData("modified success", map[string]interface{}{"port": t.Port})
 		}
-		s.AjaxOk("modified success")
 	}
 }
 
@@ -238,9 +301,74 @@ func (s *IndexController) DelHost() {
 	if err := file.GetDb().DelHost(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	accesslog.Remove(id)
+	inspect.Remove(id)
 	s.AjaxOk("delete success")
 }
 
+//purge the http cache of the host, all the cache is purged if neither id nor host is set.
+//only the admin can purge without the id, the owner of the host is checked by the id
+func (s *IndexController) PurgeCache() {
+	host := s.getEscapeString("host")
+	if id := s.GetIntNoErr("id"); id > 0 {
+		if h, err := file.GetDb().GetHostById(id); err != nil {
+			s.AjaxErr("the host is not exist")
+		} else {
+			host = h.Host
+		}
+	} else if !s.GetSession("isAdmin").(bool) {
+		s.AjaxErr("the host id is required")
+	}
+	server.PurgeHttpCache(host, s.getEscapeString("path"))
+	s.AjaxOk("purge success")
+}
+
+//the recent access log of the host, the page polls the records after the seq
+func (s *IndexController) HostAccessLog() {
+	id := s.GetIntNoErr("id")
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "host"
+		if h, err := file.GetDb().GetHostById(id); err != nil {
+			s.error()
+		} else {
+			s.Data["h"] = h
+		}
+		s.SetInfo("access log")
+		s.display("index/haccesslog")
+	} else {
+		records, seq := accesslog.Recent(id, int64(s.GetIntNoErr("seq")))
+		s.Data["json"] = map[string]interface{}{"code": 1, "seq": seq, "data": records}
+		s.ServeJSON()
+	}
+}
+
+//the captured requests of the host, the page polls the exchanges after the seq
+func (s *IndexController) HostInspect() {
+	id := s.GetIntNoErr("id")
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "host"
+		if h, err := file.GetDb().GetHostById(id); err != nil {
+			s.error()
+		} else {
+			s.Data["h"] = h
+		}
+		s.SetInfo("inspect")
+		s.display("index/hinspect")
+	} else {
+		exchanges, seq := inspect.Recent(id, int64(s.GetIntNoErr("seq")))
+		s.Data["json"] = map[string]interface{}{"code": 1, "seq": seq, "data": exchanges}
+		s.ServeJSON()
+	}
+}
+
+//resend a captured request of the host
+func (s *IndexController) HostReplay() {
+	if err := server.ReplayHttpRequest(s.GetIntNoErr("id"), int64(s.GetIntNoErr("exchange_id"))); err != nil {
+		s.AjaxErr("replay error " + err.Error())
+	}
+	s.AjaxOk("replay success")
+}
+
 func (s *IndexController) AddHost() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["client_id"] = s.getEscapeString("client_id")
@@ -251,17 +379,48 @@ func (s *IndexController) AddHost() {
 		h := &file.Host{
 			Id:           int(file.GetDb().JsonDb.GetHostId()),
 			Host:         s.getEscapeString("host"),
-			Target:       &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
+			Target:       &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy"), Strategy: s.getEscapeString("lb_strategy"), ProxyProtocol: s.GetIntNoErr("proxy_protocol")},
 			HeaderChange: s.getEscapeString("header"),
 			HostChange:   s.getEscapeString("hostchange"),
 			Remark:       s.getEscapeString("remark"),
 			Location:     s.getEscapeString("location"),
-			Flow:         &file.Flow{},
+			Flow:         &file.Flow{FlowLimit: int64(s.GetIntNoErr("flow_limit"))},
+			Limit:        file.Limit{RateLimit: s.GetIntNoErr("rate_limit"), InRateLimit: s.GetIntNoErr("in_rate_limit"), OutRateLimit: s.GetIntNoErr("out_rate_limit"), RateBurst: s.GetIntNoErr("rate_burst"), MaxConn: s.GetIntNoErr("max_conn")},
 			Scheme:       s.getEscapeString("scheme"),
+			ForceHttps:   s.GetBoolNoErr("force_https"),
+			HstsMaxAge:   s.GetIntNoErr("hsts_max_age"),
 			KeyFilePath:  s.getEscapeString("key_file_path"),
 			CertFilePath: s.getEscapeString("cert_file_path"),
+			ClientCa:     s.getEscapeString("client_ca"),
+			ClientAuth:   s.getEscapeString("client_auth"),
+			CertHeader:   s.getEscapeString("cert_header"),
+			RouteRules:   s.GetString("route_rules"),
+			RespHeader:   s.GetString("resp_header"),
+			CorsOrigin:   s.getEscapeString("cors_origin"),
+			NoCache:      s.GetBoolNoErr("no_cache"),
+			Compression:  s.getEscapeString("compression"),
+			CompressType: s.getEscapeString("compress_type"),
+			ErrorPage:    s.GetString("error_page"),
+			AccessLog:    s.GetBoolNoErr("access_log"),
+			Inspect:      s.GetBoolNoErr("inspect"),
+			IpRateLimit:  s.GetIntNoErr("ip_rate_limit"),
+			IpRateBurst:  s.GetIntNoErr("ip_rate_burst"),
 		}
+		h.Target.TlsServerName = s.getEscapeString("tls_server_name")
+		h.Target.TlsSkipVerify = s.GetBoolNoErr("tls_skip_verify")
+		h.Target.TlsCa = s.getEscapeString("tls_ca")
+		h.Target.TlsCert = s.getEscapeString("tls_cert")
+		h.Target.TlsKey = s.getEscapeString("tls_key")
 		var err error
+		if _, err = file.ParseRouteRules(h.RouteRules); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if _, err = template.New("").Parse(h.ErrorPage); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if h.ClientCa != "" && !common.FileExists(h.ClientCa) {
+			s.AjaxErr("the client ca file is not exist")
+		}
 		if h.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 			s.AjaxErr("add error the client can not be found")
 		}
@@ -297,21 +456,57 @@ func (s *IndexController) EditHost() {
 					return
 				}
 			}
+			if _, err := file.ParseRouteRules(s.GetString("route_rules")); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			if _, err := template.New("").Parse(s.GetString("error_page")); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			if ca := s.getEscapeString("client_ca"); ca != "" && !common.FileExists(ca) {
+				s.AjaxErr("the client ca file is not exist")
+			}
 			if client, err := file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 			} else {
 				h.Client = client
 			}
 			h.Host = s.getEscapeString("host")
-			h.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			h.Target = &file.Target{TargetStr: s.getEscapeString("target"), Strategy: s.getEscapeString("lb_strategy"), ProxyProtocol: s.GetIntNoErr("proxy_protocol")}
 			h.HeaderChange = s.getEscapeString("header")
 			h.HostChange = s.getEscapeString("hostchange")
 			h.Remark = s.getEscapeString("remark")
 			h.Location = s.getEscapeString("location")
 			h.Scheme = s.getEscapeString("scheme")
+			h.ForceHttps = s.GetBoolNoErr("force_https")
+			h.HstsMaxAge = s.GetIntNoErr("hsts_max_age")
 			h.KeyFilePath = s.getEscapeString("key_file_path")
 			h.CertFilePath = s.getEscapeString("cert_file_path")
+			h.ClientCa = s.getEscapeString("client_ca")
+			h.ClientAuth = s.getEscapeString("client_auth")
+			h.CertHeader = s.getEscapeString("cert_header")
+			h.RouteRules = s.GetString("route_rules")
+			h.RespHeader = s.GetString("resp_header")
+			h.CorsOrigin = s.getEscapeString("cors_origin")
+			h.NoCache = s.GetBoolNoErr("no_cache")
+			h.Compression = s.getEscapeString("compression")
+			h.CompressType = s.getEscapeString("compress_type")
+			h.ErrorPage = s.GetString("error_page")
+			h.AccessLog = s.GetBoolNoErr("access_log")
+			h.Inspect = s.GetBoolNoErr("inspect")
+			h.IpRateLimit = s.GetIntNoErr("ip_rate_limit")
+			h.IpRateBurst = s.GetIntNoErr("ip_rate_burst")
+			h.Flow.FlowLimit = int64(s.GetIntNoErr("flow_limit"))
+			h.RateLimit = s.GetIntNoErr("rate_limit")
+			h.InRateLimit = s.GetIntNoErr("in_rate_limit")
+			h.OutRateLimit = s.GetIntNoErr("out_rate_limit")
+			h.RateBurst = s.GetIntNoErr("rate_burst")
+			h.MaxConn = s.GetIntNoErr("max_conn")
 			h.Target.LocalProxy = s.GetBoolNoErr("local_proxy")
+			h.Target.TlsServerName = s.getEscapeString("tls_server_name")
+			h.Target.TlsSkipVerify = s.GetBoolNoErr("tls_skip_verify")
+			h.Target.TlsCa = s.getEscapeString("tls_ca")
+			h.Target.TlsCert = s.getEscapeString("tls_cert")
+			h.Target.TlsKey = s.getEscapeString("tls_key")
 			file.GetDb().JsonDb.StoreHostToJsonFile()
 		}
 		s.AjaxOk("modified success")
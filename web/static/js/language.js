@@ -144,6 +144,7 @@ function submitform(action, url, postdata) {
         case 'start':
         case 'stop':
         case 'delete':
+        case 'purge':
             var langobj = languages['content']['confirm'][action];
             action = (langobj[languages['current']] || langobj[languages['default']] || 'Are you sure you want to ' + action + ' it?');
             if (! confirm(action)) return;
@@ -183,4 +184,14 @@ function changeunit(limit) {
         return sizeStr.substring(0, index) + sizeStr.substr(index + 3, 2);
     }
     return size;
-}
\ No newline at end of file
+}
+
+function formattarget(target) {
+    var ejected = target.EjectedArr || [];
+    return target.TargetStr.split("\n").map(function (v) {
+        if (ejected.indexOf(v.trim().split(" ")[0]) > -1) {
+            return v + ' <span class="badge badge-danger" langtag="word-ejected"></span>';
+        }
+        return v;
+    }).join("<br/>");
+}